@@ -13,10 +13,12 @@ import (
 	"github.com/Miku7676/webhook-delivery-service/config"
 	_ "github.com/Miku7676/webhook-delivery-service/docs"
 	"github.com/Miku7676/webhook-delivery-service/handlers"
+	"github.com/Miku7676/webhook-delivery-service/helpers"
 	"github.com/Miku7676/webhook-delivery-service/models"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"gorm.io/driver/postgres"
@@ -38,8 +40,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
+	// Tasks stored before task states existed are marked finished before anything can queue them again
+	if err := helpers.MigrateTaskLifecycle(database); err != nil {
+		log.Fatalf("Failed to migrate webhook tasks: %v", err)
+	}
 	// AutoMigrate models
-	if err := database.AutoMigrate(&models.Subscription{}, &models.WebhookTask{}, &models.DeliveryLog{}); err != nil {
+	if err := database.AutoMigrate(&models.Subscription{}, &models.WebhookTask{}, &models.DeliveryLog{}, &models.ReplayJob{}, &models.OrderingSequence{}, &models.OutboxMessage{}, &models.IdempotencyKey{}); err != nil {
 		log.Fatalf("Failed to automigrate models: %v", err)
 	}
 
@@ -50,10 +56,23 @@ func main() {
 	}
 	redisClient := redis.NewClient(redisOpt)
 
+	// Asynq client used to enqueue deliveries
+	queueClient := asynq.NewClient(helpers.AsynqRedisOpt(redisOpt))
+	defer queueClient.Close()
+
+	// Asynq inspector used to look into the queue (dead letters)
+	inspector := asynq.NewInspector(helpers.AsynqRedisOpt(redisOpt))
+	defer inspector.Close()
+
 	// Setup Handler Dependencies
 	dependencyHandler := &handlers.HandlerDependencies{
 		DB:          database,
 		RedisClient: redisClient,
+		QueueClient: queueClient,
+		Inspector:   inspector,
+
+		IdempotencyWindow: cfg.IdempotencyWindow,
+		EventsSecret:      cfg.EventsSecret,
 	}
 
 	// Setup Gin Router
@@ -63,7 +82,7 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Allow all for now (can restrict later)
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "X-Hub-Signature-256"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "X-Hub-Signature-256", "Idempotency-Key"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 	}))
@@ -80,10 +99,25 @@ func main() {
 	r.GET("/subscriptions/:id", dependencyHandler.GetSubscription())
 	r.PUT("/subscriptions/:id", dependencyHandler.UpdateSubscription())
 	r.DELETE("/subscriptions/:id", dependencyHandler.DeleteSubscription())
-
-	r.POST("/ingest/:subscription_id", handlers.IngestWebhook(database))
-	r.GET("/status/:webhook_id", handlers.GetDeliveryStatusByWebhook(database))
+	r.GET("/subscriptions/:id/breaker", dependencyHandler.GetSubscriptionBreaker())
+	r.POST("/subscriptions/:id/enable", dependencyHandler.EnableSubscription())
+	r.POST("/subscriptions/:id/pause", dependencyHandler.PauseSubscription())
+	r.POST("/subscriptions/:id/resume", dependencyHandler.ResumeSubscription())
+
+	r.POST("/ingest/:subscription_id", dependencyHandler.IngestWebhook())
+	r.POST("/events", dependencyHandler.PublishEvent())
+	r.GET("/status/:webhook_id", dependencyHandler.GetDeliveryStatusByWebhook())
+	r.DELETE("/status/:webhook_id", dependencyHandler.CancelWebhook())
+	r.POST("/status/:webhook_id/redeliver", dependencyHandler.RedeliverWebhook())
 	r.GET("/subscriptions/:id/logs", handlers.GetRecentLogsBySubscription(database))
+	r.GET("/subscriptions/:id/scheduled", dependencyHandler.ListScheduledDeliveries())
+	r.DELETE("/subscriptions/:id/scheduled/:webhook_id", dependencyHandler.CancelScheduledDelivery())
+	r.POST("/subscriptions/:id/replay", dependencyHandler.ReplaySubscription())
+	r.GET("/replays/:id", dependencyHandler.GetReplayJob())
+
+	r.GET("/dead-letters", dependencyHandler.ListDeadLetters())
+	r.POST("/dead-letters/:id/retry", dependencyHandler.RetryDeadLetter())
+	r.DELETE("/dead-letters/:id", dependencyHandler.DeleteDeadLetter())
 
 	port := cfg.Port
 	if port == "" {
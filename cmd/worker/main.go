@@ -7,7 +7,6 @@ import (
 	"github.com/Miku7676/webhook-delivery-service/config"
 	"github.com/Miku7676/webhook-delivery-service/helpers"
 	"github.com/go-redis/redis/v8"
-	"github.com/hibiken/asynq"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -24,13 +23,7 @@ func main() {
 		log.Fatalf("Failed to parse Redis URL: %v", err)
 	}
 	redisClient := redis.NewClient(opt)
-	redisOpt := asynq.RedisClientOpt{
-		Addr:     opt.Addr,
-		Username: opt.Username,
-		Password: opt.Password,
-		TLSConfig: opt.TLSConfig,
-		DB: opt.DB,
-	}
+	redisOpt := helpers.AsynqRedisOpt(opt)
 
 	//connect to database
 	dburl := cfg.DBURL
@@ -39,10 +32,19 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	log.Println("Starting worker + janitor...")
+	log.Println("Starting worker + outbox relay + reconciler + replays + janitor...")
 
 	// Start the background Worker to process webhook tasks
-	go helpers.StartWorker(redisClient,redisOpt)
+	go helpers.StartWorker(database, redisClient, redisOpt, cfg)
+
+	// Start the relay queueing the tasks the API could not queue itself
+	go helpers.StartOutboxRelay(database, redisOpt)
+
+	// Start the reconciler queueing again the tasks lost by redis
+	go helpers.StartReconciler(database, redisClient, redisOpt, cfg)
+
+	// Start the runner of the replay jobs created through the API
+	go helpers.StartReplayRunner(database, redisOpt)
 
 	// Start the background Log Cleaner
 	go helpers.StartLogClean(database)
@@ -53,7 +55,7 @@ func main() {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("ok"))
 		})
-		log.Println("Health server running at :9090/healthz")
+		log.Println("Health server running at :9090/healthz, metrics at :9090/debug/vars")
 		if err := http.ListenAndServe(":9090", nil); err != nil {
 			log.Fatalf("Failed to start health server: %v", err)
 		}
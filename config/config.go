@@ -3,12 +3,35 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
 	DBURL    string
 	RedisURL string
 	Port     string
+
+	// Circuit breaker: open after this many consecutive failures, probe again after the cooldown
+	BreakerFailureThreshold int
+	BreakerCooldown         time.Duration
+
+	// Auto-disable: subscriptions failing this many times in a row, or for this long, are disabled (0 turns the rule off)
+	AutoDisableFailureStreak int
+	AutoDisableFailureWindow time.Duration
+
+	// Deliveries in flight at once per subscription, unless the subscription sets its own limit (0 means unlimited)
+	SubscriptionConcurrency int
+
+	// Reconciler: how often it looks for unfinished tasks missing from the queue (0 turns it off), and how far back
+	ReconcileInterval time.Duration
+	ReconcileLookback time.Duration
+
+	// How long an Idempotency-Key sent to ingest is remembered
+	IdempotencyWindow time.Duration
+
+	// Secret producers sign POST /events with, unsigned events only reach subscriptions without a secret
+	EventsSecret string
 }
 
 func Load() *Config {
@@ -16,6 +39,21 @@ func Load() *Config {
 		DBURL:    os.Getenv("DB_URL"),
 		RedisURL: os.Getenv("REDIS_URL"),
 		Port:     os.Getenv("PORT"),
+
+		BreakerFailureThreshold: getEnvInt("BREAKER_FAILURE_THRESHOLD", 5),
+		BreakerCooldown:         getEnvDuration("BREAKER_COOLDOWN", time.Minute),
+
+		AutoDisableFailureStreak: getEnvInt("AUTO_DISABLE_FAILURE_STREAK", 50),
+		AutoDisableFailureWindow: getEnvDuration("AUTO_DISABLE_FAILURE_WINDOW", 72*time.Hour),
+
+		SubscriptionConcurrency: getEnvInt("SUBSCRIPTION_CONCURRENCY", 2),
+
+		ReconcileInterval: getEnvDuration("RECONCILE_INTERVAL", 5*time.Minute),
+		ReconcileLookback: getEnvDuration("RECONCILE_LOOKBACK", 24*time.Hour),
+
+		IdempotencyWindow: getEnvDuration("IDEMPOTENCY_WINDOW", 24*time.Hour),
+
+		EventsSecret: os.Getenv("EVENTS_SECRET"),
 	}
 
 	if c.DBURL == "" || c.RedisURL == "" {
@@ -28,3 +66,31 @@ func Load() *Config {
 
 	return c
 }
+
+// getEnvInt reads an integer environment variable, falling back to def when unset or invalid
+func getEnvInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("Invalid value for %s, using %d: %v", key, def, err)
+		return def
+	}
+	return n
+}
+
+// getEnvDuration reads a duration environment variable (e.g. "30s", "5m"), falling back to def when unset or invalid
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("Invalid value for %s, using %s: %v", key, def, err)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Miku7676/webhook-delivery-service/helpers"
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+// page size used when scanning asynq task sets
+const scanPageSize = 100
+
+// ListDeadLetters godoc
+// @Summary List dead letters
+// @Description Lists deliveries that used up their retries, optionally filtered by subscription
+// @Tags Dead Letters
+// @Produce json
+// @Param subscription_id query string false "Subscription ID"
+// @Param limit query int false "Maximum number of dead letters to return (default 100)"
+// @Success 200 {array} models.DeadLetter
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /dead-letters [get]
+func (h *HandlerDependencies) ListDeadLetters() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Optional subscription filter
+		var subID uuid.UUID
+		if raw := c.Query("subscription_id"); raw != "" {
+			parsedID, err := uuid.Parse(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+				return
+			}
+			subID = parsedID
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+
+		// scan the archived set page by page until we have enough matches
+		deadLetters := []models.DeadLetter{}
+		for page := 1; len(deadLetters) < limit; page++ {
+			tasks, err := h.Inspector.ListArchivedTasks(helpers.DefaultQueue, asynq.PageSize(scanPageSize), asynq.Page(page))
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				break // nothing has been queued yet
+			}
+			if err != nil {
+				log.Printf("Failed to list archived tasks: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dead letters"})
+				return
+			}
+
+			for _, info := range tasks {
+				deadLetter, ok := toDeadLetter(info)
+				if !ok || (subID != uuid.Nil && deadLetter.SubscriptionID != subID) {
+					continue
+				}
+				deadLetters = append(deadLetters, deadLetter)
+				if len(deadLetters) == limit {
+					break
+				}
+			}
+
+			if len(tasks) < scanPageSize {
+				break // last page
+			}
+		}
+
+		c.JSON(http.StatusOK, deadLetters)
+	}
+}
+
+// RetryDeadLetter godoc
+// @Summary Retry a dead letter
+// @Description Moves a dead letter back into the queue so it is delivered again
+// @Tags Dead Letters
+// @Produce json
+// @Param id path string true "Dead letter ID"
+// @Success 202 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /dead-letters/{id}/retry [post]
+func (h *HandlerDependencies) RetryDeadLetter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !h.isDeadLetter(c, id) {
+			return
+		}
+
+		if err := h.Inspector.RunTask(helpers.DefaultQueue, id); err != nil {
+			log.Printf("Failed to retry dead letter %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry dead letter"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "id": id})
+	}
+}
+
+// DeleteDeadLetter godoc
+// @Summary Delete a dead letter
+// @Description Permanently removes a dead letter
+// @Tags Dead Letters
+// @Param id path string true "Dead letter ID"
+// @Success 204 "No Content"
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /dead-letters/{id} [delete]
+func (h *HandlerDependencies) DeleteDeadLetter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !h.isDeadLetter(c, id) {
+			return
+		}
+
+		if err := h.Inspector.DeleteTask(helpers.DefaultQueue, id); err != nil {
+			log.Printf("Failed to delete dead letter %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete dead letter"})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// isDeadLetter checks that the asynq task exists and is archived, writing the error response if not
+func (h *HandlerDependencies) isDeadLetter(c *gin.Context, id string) bool {
+	info, err := h.Inspector.GetTaskInfo(helpers.DefaultQueue, id)
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to fetch task %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dead letter"})
+		return false
+	}
+	if info.State != asynq.TaskStateArchived {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return false
+	}
+	return true
+}
+
+// toDeadLetter decodes the webhook task carried by an archived asynq task
+func toDeadLetter(info *asynq.TaskInfo) (models.DeadLetter, bool) {
+	if info.Type == helpers.TaskTypeDeliverBatch {
+		return toBatchDeadLetter(info)
+	}
+	if info.Type != helpers.TaskTypeDeliver {
+		return models.DeadLetter{}, false
+	}
+
+	var task models.WebhookTask
+	if err := json.Unmarshal(info.Payload, &task); err != nil {
+		log.Printf("Failed to unmarshal archived task %s: %v", info.ID, err)
+		return models.DeadLetter{}, false
+	}
+
+	return models.DeadLetter{
+		ID:             info.ID,
+		WebhookTaskID:  task.ID,
+		SubscriptionID: task.SubscriptionID,
+		EventType:      task.EventType,
+		Payload:        task.Payload,
+		Retried:        info.Retried,
+		MaxRetry:       helpers.PolicyMaxRetry(info.MaxRetry),
+		LastError:      info.LastErr,
+		LastFailedAt:   info.LastFailedAt,
+	}, true
+}
+
+// toBatchDeadLetter decodes the batch carried by an archived asynq task
+func toBatchDeadLetter(info *asynq.TaskInfo) (models.DeadLetter, bool) {
+	var batch helpers.WebhookBatch
+	if err := json.Unmarshal(info.Payload, &batch); err != nil {
+		log.Printf("Failed to unmarshal archived batch %s: %v", info.ID, err)
+		return models.DeadLetter{}, false
+	}
+
+	taskIDs := make([]uuid.UUID, len(batch.Tasks))
+	for i, task := range batch.Tasks {
+		taskIDs[i] = task.ID
+	}
+	return models.DeadLetter{
+		ID:             info.ID,
+		SubscriptionID: batch.SubscriptionID,
+		Retried:        info.Retried,
+		MaxRetry:       helpers.PolicyMaxRetry(info.MaxRetry),
+		LastError:      info.LastErr,
+		LastFailedAt:   info.LastFailedAt,
+		BatchID:        &batch.ID,
+		WebhookTaskIDs: taskIDs,
+	}, true
+}
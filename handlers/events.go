@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/helpers"
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PublishEvent godoc
+// @Summary Publish an event
+// @Description Accepts a typed event and queues one delivery for every subscription listening to the event type. When the service has an events secret, the X-Hub-Signature-256 header (HMAC-SHA256 of the request body using that secret) is required. Unsigned events skip subscriptions that have a secret.
+// @Tags Webhook
+// @Accept json
+// @Produce json
+// @Param X-Hub-Signature-256 header string false "HMAC SHA256 signature of the request body using the events secret"
+// @Param event body models.PublishEventRequest true "Event type and data"
+// @Param deliver_at query string false "Deliver at this time (RFC 3339)"
+// @Param delay query string false "Deliver after this delay, in seconds or as a duration like 15m"
+// @Param ttl query string false "Don't deliver after this long, in seconds or as a duration like 5m"
+// @Success 202 {object} map[string]interface{}
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /events [post]
+func (h *HandlerDependencies) PublishEvent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The signature covers the request body as it was sent
+		raw, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+
+		// Verify the producer when the service has an events secret. Without one anybody can publish,
+		// so subscriptions with a secret don't get the event: their receivers trust our signature.
+		signed := false
+		if h.EventsSecret != "" {
+			receivedSignature := c.GetHeader("X-Hub-Signature-256")
+			if receivedSignature == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing X-Hub-Signature-256 header"})
+				return
+			}
+			if !hmac.Equal([]byte(receivedSignature), []byte(computeHMACSHA256(raw, h.EventsSecret))) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+				return
+			}
+			signed = true
+		}
+
+		var event models.PublishEventRequest
+		if err := c.ShouldBindJSON(&event); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event"})
+			return
+		}
+
+		// Delivery time, when the producer wants it later
+		scheduledAt, err := parseSchedule(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ttl, err := parseTTL(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The event as a whole is delivered to the subscribers
+		body, err := json.Marshal(event)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Payload marshal failed"})
+			return
+		}
+
+		// Find every subscription listening to this event type
+		subs, err := findSubscriptionsForEvent(h.DB, event.Type, signed)
+		if err != nil {
+			log.Printf("Failed to fetch subscriptions for %s: %v", event.Type, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		// Create one task per subscription in a single insert
+		now := time.Now()
+		tasks := make([]models.WebhookTask, 0, len(subs))
+		for _, sub := range subs {
+			task := models.WebhookTask{
+				ID:             uuid.New(),
+				SubscriptionID: sub.ID,
+				EventType:      event.Type,
+				Payload:        string(body),
+				ScheduledAt:    scheduledAt,
+				CreatedAt:      now,
+			}
+			task.ExpiresAt = taskExpiry(ttl, sub, task)
+			tasks = append(tasks, task)
+		}
+		if len(tasks) > 0 {
+			err := h.DB.Transaction(func(tx *gorm.DB) error {
+				for i := range tasks {
+					if err := helpers.AssignSequence(tx, &tasks[i], subs[i]); err != nil {
+						return err
+					}
+				}
+				if err := tx.Create(&tasks).Error; err != nil {
+					return err
+				}
+				return helpers.AddToOutbox(tx, tasks...)
+			})
+			if err != nil {
+				log.Printf("Failed to create Webhook Tasks: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				return
+			}
+		}
+
+		// Enqueue one job per task. Once one fails the rest are left to the relay of the worker too.
+		taskIDs := make([]uuid.UUID, 0, len(tasks))
+		dispatch := true
+		for i, task := range tasks {
+			if dispatch {
+				dispatch = helpers.DispatchFromOutbox(h.DB, h.QueueClient, h.Inspector, task, subs[i])
+			}
+			taskIDs = append(taskIDs, task.ID)
+		}
+
+		if scheduledAt != nil {
+			c.JSON(http.StatusAccepted, gin.H{"status": "scheduled", "event_type": event.Type, "task_ids": taskIDs, "deliver_at": scheduledAt})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "event_type": event.Type, "task_ids": taskIDs})
+	}
+}
+
+// findSubscriptionsForEvent returns subscriptions whose event types contain the given type or the "*" wildcard.
+// Disabled subscriptions are skipped, and so are subscriptions with a secret when the event is not signed.
+func findSubscriptionsForEvent(db *gorm.DB, eventType string, signed bool) ([]models.Subscription, error) {
+	match, _ := json.Marshal([]string{eventType})
+	wildcard, _ := json.Marshal([]string{"*"})
+
+	query := db.Where("event_types @> ? OR event_types @> ?", string(match), string(wildcard)).
+		Where("status <> ?", models.SubscriptionDisabled)
+	if !signed {
+		query = query.Where("COALESCE(secret, '') = ''")
+	}
+
+	// ordered subscriptions lock their sequence counters in this order
+	var subs []models.Subscription
+	err := query.Order("id").Find(&subs).Error
+	return subs, err
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// errIdempotencyMismatch is returned when a key is reused with a different payload
+var errIdempotencyMismatch = errors.New("idempotency key reused with a different payload")
+
+// idempotentRepeat is returned when the key was already used with the same payload, no new task is created
+type idempotentRepeat struct {
+	taskID uuid.UUID
+}
+
+func (r *idempotentRepeat) Error() string {
+	return "repeated request for task " + r.taskID.String()
+}
+
+// payloadHash is what a reused key is compared by
+func payloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey records the key for the new task, it has to run in the transaction creating the task.
+// A concurrent request with the same key waits on the row until that transaction ends.
+// Keys past their window are taken over by the new task.
+func claimIdempotencyKey(tx *gorm.DB, subID uuid.UUID, key, hash string, taskID uuid.UUID, window time.Duration) error {
+	now := time.Now()
+	idem := models.IdempotencyKey{
+		SubscriptionID: subID,
+		Key:            key,
+		RequestHash:    hash,
+		WebhookTaskID:  taskID,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(window),
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&idem)
+	if result.Error != nil || result.RowsAffected == 1 {
+		return result.Error
+	}
+
+	var existing models.IdempotencyKey
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&existing, "subscription_id = ? AND key = ?", subID, key).Error
+	if err != nil {
+		return err
+	}
+	if existing.ExpiresAt.After(now) {
+		if existing.RequestHash != hash {
+			return errIdempotencyMismatch
+		}
+		return &idempotentRepeat{taskID: existing.WebhookTaskID}
+	}
+
+	return tx.Model(&existing).Updates(map[string]interface{}{
+		"request_hash":    hash,
+		"webhook_task_id": taskID,
+		"created_at":      now,
+		"expires_at":      idem.ExpiresAt,
+	}).Error
+}
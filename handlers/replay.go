@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/helpers"
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// default number of tasks re-enqueued per second by a replay job
+const defaultReplayRate = 10
+
+// ReplaySubscription godoc
+// @Summary Replay deliveries of a subscription
+// @Description Starts a job that re-enqueues the webhook tasks of a subscription created in the given time range, at a controlled rate. By default only tasks without a successful delivery are replayed.
+// @Tags Subscriptions
+// @Accept json
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Param replay body models.ReplayRequest true "Replay time range and filters"
+// @Success 202 {object} models.ReplayJob
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/replay [post]
+func (h *HandlerDependencies) ReplaySubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			return
+		}
+
+		var req models.ReplayRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !req.From.Before(req.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+			return
+		}
+		if req.Status == "" {
+			req.Status = "failed"
+		}
+		if req.Rate == 0 {
+			req.Rate = defaultReplayRate
+		}
+
+		var sub models.Subscription
+		if err := h.DB.First(&sub, "id = ?", subID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		if sub.Status == models.SubscriptionDisabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is disabled"})
+			return
+		}
+
+		job := models.ReplayJob{
+			ID:             uuid.New(),
+			SubscriptionID: subID,
+			From:           req.From,
+			To:             req.To,
+			StatusFilter:   req.Status,
+			Rate:           req.Rate,
+			Status:         models.ReplayStatusRunning,
+			CreatedAt:      time.Now(),
+		}
+
+		// Count the tasks to replay up front, so the job has a fixed size
+		var total int64
+		if err := helpers.ReplayTasks(h.DB, job).Count(&total).Error; err != nil {
+			log.Printf("Failed to select tasks for replay: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to select tasks"})
+			return
+		}
+		job.Total = int(total)
+
+		// A worker picks the job up and re-enqueues in the background, progress is tracked on the job row
+		if err := h.DB.Create(&job).Error; err != nil {
+			log.Printf("Failed to create replay job: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// GetReplayJob godoc
+// @Summary Get a replay job
+// @Description Shows the progress of a replay job
+// @Tags Subscriptions
+// @Produce json
+// @Param id path string true "Replay Job ID"
+// @Success 200 {object} models.ReplayJob
+// @Failure 404 {object} map[string]string
+// @Router /replays/{id} [get]
+func (h *HandlerDependencies) GetReplayJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var job models.ReplayJob
+		if err := h.DB.First(&job, "id = ?", c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Replay job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/helpers"
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+// deliveries can't be scheduled further ahead than this
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// parseSchedule reads the deliver_at (RFC 3339) or delay (seconds or a duration like "15m") query parameter.
+// Returns nil when the delivery should go out right away.
+func parseSchedule(c *gin.Context) (*time.Time, error) {
+	deliverAt, delay := c.Query("deliver_at"), c.Query("delay")
+	if deliverAt != "" && delay != "" {
+		return nil, errors.New("use either deliver_at or delay, not both")
+	}
+
+	var at time.Time
+	switch {
+	case deliverAt != "":
+		parsed, err := time.Parse(time.RFC3339, deliverAt)
+		if err != nil {
+			return nil, errors.New("deliver_at must be an RFC 3339 time")
+		}
+		at = parsed
+	case delay != "":
+		d, err := parseDuration(delay)
+		if err != nil {
+			return nil, errors.New("delay must be a positive number of seconds or a duration like 15m")
+		}
+		at = time.Now().Add(d)
+	default:
+		return nil, nil
+	}
+
+	if time.Until(at) > maxScheduleAhead {
+		return nil, fmt.Errorf("deliveries can't be scheduled more than %d days ahead", int(maxScheduleAhead.Hours()/24))
+	}
+	if !at.After(time.Now()) {
+		return nil, nil // already due
+	}
+	return &at, nil
+}
+
+// parseTTL reads the ttl (seconds or a duration like "5m") query parameter, 0 when missing
+func parseTTL(c *gin.Context) (time.Duration, error) {
+	ttl := c.Query("ttl")
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := parseDuration(ttl)
+	if err != nil || d == 0 {
+		return 0, errors.New("ttl must be a positive number of seconds or a duration like 5m")
+	}
+	return d, nil
+}
+
+// taskExpiry is the time after which a task is no longer delivered: the ttl of the request,
+// or else the default TTL of the subscription, counted from the delivery time
+func taskExpiry(ttl time.Duration, sub models.Subscription, task models.WebhookTask) *time.Time {
+	if ttl == 0 {
+		ttl = time.Duration(sub.DefaultTTL) * time.Second
+	}
+	if ttl == 0 {
+		return nil
+	}
+
+	start := task.CreatedAt
+	if task.ScheduledAt != nil {
+		start = *task.ScheduledAt
+	}
+	expiresAt := start.Add(ttl)
+	return &expiresAt
+}
+
+// parseDuration reads a number of seconds or a Go duration like "15m"
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if seconds, convErr := strconv.Atoi(value); convErr == nil {
+		d, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err == nil && d < 0 {
+		err = errors.New("negative duration")
+	}
+	return d, err
+}
+
+// ListScheduledDeliveries godoc
+// @Summary List scheduled deliveries of a subscription
+// @Description Lists webhooks of the subscription that are waiting for their delivery time
+// @Tags Webhook
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Success 200 {array} models.ScheduledDelivery
+// @Failure 400 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/scheduled [get]
+func (h *HandlerDependencies) ListScheduledDeliveries() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			return
+		}
+
+		// the tasks themselves know their delivery time, also while they wait in the outbox
+		var tasks []models.WebhookTask
+		err = h.DB.Where("subscription_id = ? AND scheduled_at > ? AND state = ?", subID, time.Now(), models.TaskStateQueued).
+			Order("scheduled_at asc").
+			Find(&tasks).Error
+		if err != nil {
+			log.Printf("Failed to list scheduled tasks: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scheduled deliveries"})
+			return
+		}
+
+		scheduled := make([]models.ScheduledDelivery, len(tasks))
+		for i, task := range tasks {
+			scheduled[i] = models.ScheduledDelivery{
+				ID:             task.ID.String(),
+				WebhookTaskID:  task.ID,
+				SubscriptionID: task.SubscriptionID,
+				EventType:      task.EventType,
+				Payload:        task.Payload,
+				DeliverAt:      *task.ScheduledAt,
+			}
+		}
+
+		c.JSON(http.StatusOK, scheduled)
+	}
+}
+
+// CancelScheduledDelivery godoc
+// @Summary Cancel a scheduled delivery
+// @Description Removes a webhook of the subscription that is waiting for its delivery time, it is never delivered
+// @Tags Webhook
+// @Param id path string true "Subscription ID"
+// @Param webhook_id path string true "Webhook Task ID"
+// @Success 204 "No Content"
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/scheduled/{webhook_id} [delete]
+func (h *HandlerDependencies) CancelScheduledDelivery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subID, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			return
+		}
+		taskID, err := uuid.Parse(c.Param("webhook_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+
+		var task models.WebhookTask
+		err = h.DB.Where("id = ? AND subscription_id = ? AND scheduled_at > ? AND state = ?", taskID, subID, time.Now(), models.TaskStateQueued).
+			First(&task).Error
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled delivery not found"})
+			return
+		}
+
+		// The asynq task has the webhook task's ID. There is none yet while the task waits in the outbox.
+		info, err := h.Inspector.GetTaskInfo(helpers.DefaultQueue, taskID.String())
+		switch {
+		case errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound):
+			info = nil
+		case err != nil:
+			log.Printf("Failed to fetch scheduled task %s: %v", taskID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled delivery"})
+			return
+		case info.State != asynq.TaskStateScheduled:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled delivery not found"}) // became due in the meantime
+			return
+		}
+
+		// Mark it first, so a copy queued later by the relay or the reconciler is dropped
+		if err := helpers.MarkCancelled(c, h.RedisClient, taskID); err != nil {
+			log.Printf("Failed to mark task %s as cancelled: %v", taskID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled delivery"})
+			return
+		}
+		if info != nil {
+			err := h.Inspector.DeleteTask(helpers.DefaultQueue, info.ID)
+			if err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+				log.Printf("Failed to cancel scheduled task %s: %v", info.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled delivery"})
+				return
+			}
+		}
+
+		h.recordCancellation(task)
+
+		c.Status(http.StatusNoContent)
+	}
+}
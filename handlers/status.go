@@ -1,25 +1,31 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/Miku7676/webhook-delivery-service/helpers"
 	"github.com/Miku7676/webhook-delivery-service/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
 )
 
 // GetDeliveryStatusByWebhook godoc
 // @Summary Get delivery status for a webhook
-// @Description Fetches all delivery attempts for a specific webhook ID
+// @Description Fetches the state of a webhook (attempt count, last attempt, next retry), the state of its job in the queue and all its delivery attempts, including attempts made by its redeliveries
 // @Tags Status
 // @Produce json
 // @Param webhook_id path string true "Webhook Task ID"
-// @Success 200 {array} models.DeliveryLog
+// @Success 200 {object} models.WebhookStatus
 // @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /status/{webhook_id} [get]
-func GetDeliveryStatusByWebhook(db *gorm.DB) gin.HandlerFunc {
+func (h *HandlerDependencies) GetDeliveryStatusByWebhook() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Extract webhook ID
 		webhookID := c.Param("webhook_id")
@@ -30,14 +36,184 @@ func GetDeliveryStatusByWebhook(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// fetch logs by webhook_task_id - latest first
+		// the task keeps its state after the logs are cleaned up
+		var task models.WebhookTask
+		if err := h.DB.First(&task, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+
+		// fetch logs by webhook_task_id, including redeliveries of it - latest first
 		var logs []models.DeliveryLog
-		if err := db.Where("webhook_task_id = ?", id).Order("created_at asc").Find(&logs).Error; err != nil {
+		if err := h.DB.Where("webhook_task_id = ? OR redelivery_of = ?", id, id).Order("created_at asc").Find(&logs).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch logs"})
 			return
 		}
 
-		c.JSON(http.StatusOK, logs)
+		c.JSON(http.StatusOK, models.WebhookStatus{Task: task, Attempts: logs, QueueState: h.queueState(id)})
+	}
+}
+
+// queueState is the state of the asynq task queued under the webhook task's ID, empty when redis can't tell
+func (h *HandlerDependencies) queueState(id uuid.UUID) string {
+	info, err := h.Inspector.GetTaskInfo(helpers.DefaultQueue, id.String())
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return "not_queued" // finished, batched, held or waiting in the outbox
+	}
+	if err != nil {
+		log.Printf("Failed to fetch task %s: %v", id, err)
+		return ""
+	}
+	return info.State.String()
+}
+
+// CancelWebhook godoc
+// @Summary Cancel a webhook delivery
+// @Description Stops a queued, scheduled, retrying or dead-lettered webhook from being delivered. A delivery already in progress is interrupted when possible, otherwise it is not retried.
+// @Tags Status
+// @Produce json
+// @Param webhook_id path string true "Webhook Task ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /status/{webhook_id} [delete]
+func (h *HandlerDependencies) CancelWebhook() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("webhook_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+
+		var task models.WebhookTask
+		if err := h.DB.First(&task, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+
+		// Nothing left to cancel once the webhook reached a final outcome, dead letters can still be cancelled
+		switch task.State {
+		case models.TaskStateSucceeded, models.TaskStateCancelled, models.TaskStateExpired:
+			c.JSON(http.StatusConflict, gin.H{"error": "Webhook is already " + task.State})
+			return
+		}
+
+		// Mark it first, so a worker picking it up from now on drops it
+		if err := helpers.MarkCancelled(c, h.RedisClient, id); err != nil {
+			log.Printf("Failed to mark task %s as cancelled: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel webhook"})
+			return
+		}
+
+		// Then take it out of the queue. Batched and held tasks have no asynq task of their own.
+		state := "not_queued"
+		info, err := h.Inspector.GetTaskInfo(helpers.DefaultQueue, id.String())
+		switch {
+		case errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound):
+		case err != nil:
+			log.Printf("Failed to fetch task %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel webhook"})
+			return
+		case info.State == asynq.TaskStateActive:
+			state = info.State.String()
+			if err := h.Inspector.CancelProcessing(info.ID); err != nil {
+				log.Printf("Failed to interrupt task %s: %v", id, err)
+			}
+		case info.State != asynq.TaskStateCompleted:
+			state = info.State.String()
+			if err := h.Inspector.DeleteTask(helpers.DefaultQueue, info.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+				log.Printf("Failed to delete task %s: %v", id, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel webhook"})
+				return
+			}
+		}
+
+		h.recordCancellation(task)
+
+		c.JSON(http.StatusOK, gin.H{"status": "cancelled", "task_id": id, "queue_state": state})
+	}
+}
+
+// recordCancellation writes the final delivery log of a cancelled task and makes sure it isn't delivered later
+func (h *HandlerDependencies) recordCancellation(task models.WebhookTask) {
+	var sub models.Subscription
+	h.DB.First(&sub, "id = ?", task.SubscriptionID) // only for the target URL, the subscription may be gone
+
+	logEntry := models.DeliveryLog{
+		ID:             uuid.New(),
+		WebhookTaskID:  task.ID,
+		SubscriptionID: task.SubscriptionID,
+		TargetURL:      sub.TargetURL,
+		Status:         models.DeliveryCancelled,
+		ErrorMessage:   "cancelled through the API",
+		RedeliveryOf:   task.RedeliveryOf,
+		CreatedAt:      time.Now(),
+	}
+	if err := h.DB.Create(&logEntry).Error; err != nil {
+		log.Printf("Failed to log cancellation of task %s: %v", task.ID, err)
+	}
+
+	// held tasks are not queued again on resume, ordered tasks don't block the ones behind them
+	err := h.DB.Model(&models.WebhookTask{}).Where("id = ?", task.ID).Updates(map[string]interface{}{
+		"state":         models.TaskStateCancelled,
+		"held_at":       nil,
+		"next_retry_at": nil,
+		"completed_at":  gorm.Expr("COALESCE(completed_at, ?)", time.Now()),
+	}).Error
+	if err != nil {
+		log.Printf("Failed to update cancelled task %s: %v", task.ID, err)
+	}
+}
+
+// RedeliverWebhook godoc
+// @Summary Redeliver a webhook
+// @Description Sends the stored payload of a past webhook again, to the current target URL of its subscription. The new attempts are linked to the original webhook.
+// @Tags Status
+// @Produce json
+// @Param webhook_id path string true "Webhook Task ID"
+// @Success 202 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /status/{webhook_id}/redeliver [post]
+func (h *HandlerDependencies) RedeliverWebhook() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("webhook_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+
+		// Fetch the original task
+		var original models.WebhookTask
+		if err := h.DB.First(&original, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+
+		// The subscription has to still exist to deliver to it
+		var sub models.Subscription
+		if err := h.DB.First(&sub, "id = ?", original.SubscriptionID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		if sub.Status == models.SubscriptionDisabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is disabled"})
+			return
+		}
+
+		task, err := helpers.RedeliverTask(h.DB, h.QueueClient, h.Inspector, original, sub)
+		if err != nil {
+			log.Printf("Failed to redeliver task %s: %v", original.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue task"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "task_id": task.ID, "redelivery_of": task.RedeliveryOf})
 	}
 }
 
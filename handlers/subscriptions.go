@@ -3,24 +3,35 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/Miku7676/webhook-delivery-service/helpers"
 	"github.com/Miku7676/webhook-delivery-service/models"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
 )
 
 type HandlerDependencies struct {
 	DB          *gorm.DB
 	RedisClient *redis.Client
+	QueueClient *asynq.Client
+	Inspector   *asynq.Inspector
+
+	// how long an Idempotency-Key sent to ingest is remembered
+	IdempotencyWindow time.Duration
+
+	// secret producers sign events with, empty when events are not signed
+	EventsSecret string
 }
 
 // CreateSubscription godoc
 // @Summary Create a new subscription
-// @Description Creates a subscription with a target URL and optional secret
+// @Description Creates a subscription with a target URL and optional secret. With signature_scheme "standard_webhooks" a whsec_ secret is generated if none is given.
 // @Tags Subscriptions
 // @Accept json
 // @Produce json
@@ -41,9 +52,47 @@ func (h *HandlerDependencies) CreateSubscription() gin.HandlerFunc {
 
 		//create a subscription and enter into database
 		sub := models.Subscription{
-			ID:        uuid.New(),
-			TargetURL: req.TargetURL,
-			Secret:    req.Secret,
+			ID:              uuid.New(),
+			TargetURL:       req.TargetURL,
+			Secret:          req.Secret,
+			SignatureScheme: req.SignatureScheme,
+			EventTypes:      req.EventTypes,
+			MaxAttempts:     req.MaxAttempts,
+			BackoffStrategy: req.BackoffStrategy,
+			BackoffInterval: req.BackoffInterval,
+			BackoffSchedule: req.BackoffSchedule,
+			MaxBackoff:      req.MaxBackoff,
+			RetryDeadline:   req.RetryDeadline,
+			DefaultTTL:      req.DefaultTTL,
+			NotificationURL: req.NotificationURL,
+			RateLimit:       req.RateLimit,
+			RateLimitBurst:  req.RateLimitBurst,
+			MaxConcurrency:  req.MaxConcurrency,
+			Ordered:         req.Ordered,
+			OrderingKey:     req.OrderingKey,
+			BatchSize:       req.BatchSize,
+			BatchMaxWait:    req.BatchMaxWait,
+			Status:          models.SubscriptionActive,
+		}
+		if err := prepareSignatureSecret(&sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateRetryPolicy(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateRateLimit(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateConcurrency(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateBatching(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		if err := h.DB.Create(&sub).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -76,9 +125,17 @@ func (h *HandlerDependencies) GetSubscription() gin.HandlerFunc {
 	}
 }
 
+// columns of a subscription set through the API, status and health are left to their own endpoints and the worker
+var editableSubscriptionColumns = []string{
+	"target_url", "secret", "signature_scheme", "event_types",
+	"max_attempts", "backoff_strategy", "backoff_interval", "backoff_schedule", "max_backoff", "retry_deadline", "default_ttl",
+	"notification_url", "rate_limit", "rate_limit_burst", "max_concurrency",
+	"ordered", "ordering_key", "batch_size", "batch_max_wait",
+}
+
 // UpdateSubscription godoc
 // @Summary Update a subscription
-// @Description Updates the target URL or secret of a subscription
+// @Description Updates the target URL, secret, signature scheme, event types or retry policy of a subscription
 // @Tags Subscriptions
 // @Accept json
 // @Produce json
@@ -107,15 +164,66 @@ func (h *HandlerDependencies) UpdateSubscription() gin.HandlerFunc {
 			return
 		}
 
+		// A Standard Webhooks subscription keeps its secret unless a new one is given,
+		// a generated one would break every receiver's verification
+		if updateData.Secret == "" && updateData.SignatureScheme == models.SignatureSchemeStandardWebhooks &&
+			helpers.ValidateStandardSecret(sub.Secret) == nil {
+			updateData.Secret = sub.Secret
+		}
+
 		// Update fields and save changes
 		sub.TargetURL = updateData.TargetURL
 		sub.Secret = updateData.Secret
-		h.DB.Save(&sub)
+		sub.SignatureScheme = updateData.SignatureScheme
+		sub.EventTypes = updateData.EventTypes
+		sub.MaxAttempts = updateData.MaxAttempts
+		sub.BackoffStrategy = updateData.BackoffStrategy
+		sub.BackoffInterval = updateData.BackoffInterval
+		sub.BackoffSchedule = updateData.BackoffSchedule
+		sub.MaxBackoff = updateData.MaxBackoff
+		sub.RetryDeadline = updateData.RetryDeadline
+		sub.DefaultTTL = updateData.DefaultTTL
+		if err := prepareSignatureSecret(&sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateRetryPolicy(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sub.NotificationURL = updateData.NotificationURL
+		sub.RateLimit = updateData.RateLimit
+		sub.RateLimitBurst = updateData.RateLimitBurst
+		sub.MaxConcurrency = updateData.MaxConcurrency
+		sub.Ordered = updateData.Ordered
+		sub.OrderingKey = updateData.OrderingKey
+		sub.BatchSize = updateData.BatchSize
+		sub.BatchMaxWait = updateData.BatchMaxWait
+		if err := helpers.ValidateRateLimit(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateConcurrency(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := helpers.ValidateBatching(sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Only the editable columns, the worker maintains the health fields at the same time
+		if err := h.DB.Model(&sub).Select(editableSubscriptionColumns).Updates(&sub).Error; err != nil {
+			log.Printf("Failed to update subscription %s: %v", sub.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription"})
+			return
+		}
+		if err := h.DB.First(&sub, "id = ?", sub.ID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscription"})
+			return
+		}
 
 		// Update cache
-		subBytes, _ := json.Marshal(sub)
-		cacheKey := fmt.Sprintf("subscription:%s", sub.ID)
-		h.RedisClient.Set(c.Request.Context(), cacheKey, subBytes, time.Hour)
+		h.cacheSubscription(c, sub)
 
 		c.JSON(http.StatusOK, sub)
 	}
@@ -142,3 +250,247 @@ func (h *HandlerDependencies) DeleteSubscription() gin.HandlerFunc {
 		h.RedisClient.Del(c.Request.Context(), cacheKey)
 	}
 }
+
+// prepareSignatureSecret defaults the signature scheme and makes sure subscriptions
+// using the Standard Webhooks scheme have a whsec_ secret, generating one if needed
+func prepareSignatureSecret(sub *models.Subscription) error {
+	switch sub.SignatureScheme {
+	case "":
+		sub.SignatureScheme = models.SignatureSchemeDefault
+		return nil
+	case models.SignatureSchemeDefault:
+		return nil
+	case models.SignatureSchemeStandardWebhooks:
+		if sub.Secret == "" {
+			secret, err := helpers.GenerateStandardSecret()
+			if err != nil {
+				return err
+			}
+			sub.Secret = secret
+			return nil
+		}
+		return helpers.ValidateStandardSecret(sub.Secret)
+	default:
+		return fmt.Errorf("Invalid signature scheme %q", sub.SignatureScheme)
+	}
+}
+
+// GetSubscriptionBreaker godoc
+// @Summary Get the circuit breaker of a subscription
+// @Description Shows whether deliveries to the subscription are currently held back by its circuit breaker
+// @Tags Subscriptions
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} models.BreakerState
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/breaker [get]
+func (h *HandlerDependencies) GetSubscriptionBreaker() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			return
+		}
+
+		var sub models.Subscription
+		if err := h.DB.First(&sub, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		state, err := helpers.GetBreakerState(c.Request.Context(), h.RedisClient, sub.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch circuit breaker"})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// EnableSubscription godoc
+// @Summary Re-enable a subscription
+// @Description Turns a disabled subscription back on and resets its failure streak. Paused subscriptions are resumed instead.
+// @Tags Subscriptions
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} models.Subscription
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/enable [post]
+func (h *HandlerDependencies) EnableSubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var sub models.Subscription
+
+		// Fetch the existing subscription
+		if err := h.DB.First(&sub, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+
+		// Back to active with a clean streak. Paused subscriptions have held tasks, only resume releases them.
+		result := h.DB.Model(&models.Subscription{}).
+			Where("id = ? AND status <> ?", sub.ID, models.SubscriptionPaused).
+			Updates(map[string]interface{}{
+				"status":               models.SubscriptionActive,
+				"consecutive_failures": 0,
+				"failing_since":        nil,
+				"disabled_at":          nil,
+				"disabled_reason":      "",
+			})
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is paused, use /resume instead"})
+			return
+		}
+		if err := h.DB.First(&sub, "id = ?", sub.ID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Update cache
+		h.cacheSubscription(c, sub)
+
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// PauseSubscription godoc
+// @Summary Pause a subscription
+// @Description Stops deliveries to a subscription. Webhooks are still accepted and held, without using up their retries, until the subscription is resumed.
+// @Tags Subscriptions
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} models.Subscription
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/pause [post]
+func (h *HandlerDependencies) PauseSubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var sub models.Subscription
+
+		// Fetch the existing subscription
+		if err := h.DB.First(&sub, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		if sub.Status == models.SubscriptionDisabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is disabled"})
+			return
+		}
+
+		sub.Status = models.SubscriptionPaused
+		if err := h.DB.Model(&sub).Update("status", sub.Status).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Update cache
+		h.cacheSubscription(c, sub)
+
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// ResumeSubscription godoc
+// @Summary Resume a subscription
+// @Description Restarts deliveries to a paused subscription. Webhooks held while it was paused are queued again in the order they were received.
+// @Tags Subscriptions
+// @Produce json
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /subscriptions/{id}/resume [post]
+func (h *HandlerDependencies) ResumeSubscription() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var sub models.Subscription
+
+		// Fetch the existing subscription
+		if err := h.DB.First(&sub, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		if sub.Status == models.SubscriptionDisabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is disabled"})
+			return
+		}
+
+		// Activate first, so the worker stops holding new tasks before we drain the held ones
+		sub.Status = models.SubscriptionActive
+		if err := h.DB.Model(&sub).Update("status", sub.Status).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		h.cacheSubscription(c, sub)
+
+		// Resuming an active subscription is allowed, it drains whatever a failed resume left behind
+		released, err := releaseHeldTasks(h.DB, h.QueueClient, h.Inspector, sub)
+		if err != nil {
+			log.Printf("Failed to release held tasks of subscription %s: %v", sub.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue held tasks, resume again to retry", "released": released})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"subscription": sub, "released": released})
+	}
+}
+
+// releaseHeldTasks queues the tasks held while a subscription was paused, oldest first
+func releaseHeldTasks(db *gorm.DB, client *asynq.Client, inspector *asynq.Inspector, sub models.Subscription) (int, error) {
+	released := 0
+	dispatch := true // once queueing fails the rest are left to the relay of the worker
+	for {
+		var tasks []models.WebhookTask
+		err := db.Where("subscription_id = ? AND held_at IS NOT NULL", sub.ID).
+			Order("created_at asc").
+			Limit(100).
+			Find(&tasks).Error
+		if err != nil {
+			return released, err
+		}
+		if len(tasks) == 0 {
+			return released, nil
+		}
+
+		// clear the mark and add the tasks to the outbox together, a failure here leaves them held for the next resume
+		ids := make([]uuid.UUID, len(tasks))
+		for i := range tasks {
+			tasks[i].HeldAt = nil
+			ids[i] = tasks[i].ID
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.WebhookTask{}).Where("id IN ?", ids).Update("held_at", nil).Error; err != nil {
+				return err
+			}
+			return helpers.AddToOutbox(tx, tasks...)
+		})
+		if err != nil {
+			return released, err
+		}
+
+		for _, task := range tasks {
+			if dispatch {
+				dispatch = helpers.DispatchFromOutbox(db, client, inspector, task, sub)
+			}
+			released++
+		}
+	}
+}
+
+// cacheSubscription refreshes the copy of a subscription the worker reads from redis
+func (h *HandlerDependencies) cacheSubscription(c *gin.Context, sub models.Subscription) {
+	subBytes, _ := json.Marshal(sub)
+	cacheKey := fmt.Sprintf("subscription:%s", sub.ID)
+	h.RedisClient.Set(c.Request.Context(), cacheKey, subBytes, time.Hour)
+}
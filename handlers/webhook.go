@@ -5,56 +5,62 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"time"
 
+	"github.com/Miku7676/webhook-delivery-service/helpers"
 	"github.com/Miku7676/webhook-delivery-service/models"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
-	"github.com/hibiken/asynq"
 	"gorm.io/gorm"
 )
 
 // IngestWebhook godoc
 // @Summary Ingest a webhook
-// @Description Accepts a webhook payload and queues it for delivery. If the subscription has a secret, you must provide the correct X-Hub-Signature-256 header (HMAC-SHA256 of the payload using the secret).
+// @Description Accepts a webhook payload and queues it for delivery. If the subscription has a secret, you must provide the correct X-Hub-Signature-256 header (HMAC-SHA256 of the payload using the secret). Requests repeating an Idempotency-Key get the original task_id back, a reused key with a different payload gets 409.
 // @Tags Webhook
 // @Accept json
 // @Produce json
 // @Param subscription_id path string true "Subscription ID"
 // @Param X-Hub-Signature-256 header string false "HMAC SHA256 signature of payload using secret"
+// @Param Idempotency-Key header string false "Repeats of the key with the same payload return the task of the first request"
+// @Param deliver_at query string false "Deliver at this time (RFC 3339)"
+// @Param delay query string false "Deliver after this delay, in seconds or as a duration like 15m"
+// @Param ttl query string false "Don't deliver after this long, in seconds or as a duration like 5m"
 // @Param payload body object true "Webhook payload JSON"
 // @Success 202 {object} map[string]string
 // @Failure 400 {object} map[string]string
 // @Failure 401 {object} map[string]string
+// @Failure 409 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Router /ingest/{subscription_id} [post]
-func IngestWebhook(db *gorm.DB) gin.HandlerFunc {
+func (h *HandlerDependencies) IngestWebhook() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Load Redis URL from environment
-		redisUrl := os.Getenv("REDIS_URL")
-		if redisUrl == "" {
-			log.Println("REDIS_URL not set")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		// Subscription ID
+		subID := c.Param("subscription_id")
+		parsedID, err := uuid.Parse(subID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
 			return
 		}
 
-		// Parse Redis URL properly
-		redisOpt, err := redis.ParseURL(redisUrl)
+		// Delivery time, when the producer wants it later
+		scheduledAt, err := parseSchedule(c)
 		if err != nil {
-			log.Printf("Failed to parse Redis URL: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-
-		// Subscription ID
-		subID := c.Param("subscription_id")
-		parsedID, err := uuid.Parse(subID)
+		ttl, err := parseTTL(c)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		idempotencyKey := c.GetHeader("Idempotency-Key")
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
 			return
 		}
 
@@ -74,11 +80,17 @@ func IngestWebhook(db *gorm.DB) gin.HandlerFunc {
 
 		// Fetch subscription from DB
 		var sub models.Subscription
-		if err := db.First(&sub, "id = ?", parsedID).Error; err != nil {
+		if err := h.DB.First(&sub, "id = ?", parsedID).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
 			return
 		}
 
+		// Disabled subscriptions have to be re-enabled before they accept webhooks again
+		if sub.Status == models.SubscriptionDisabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is disabled"})
+			return
+		}
+
 		// Verify Signature if secret is present
 		if sub.Secret != "" {
 			expectedSignature := computeHMACSHA256(body, sub.Secret)
@@ -100,39 +112,48 @@ func IngestWebhook(db *gorm.DB) gin.HandlerFunc {
 			ID:             uuid.New(),
 			SubscriptionID: parsedID,
 			Payload:        string(body),
+			ScheduledAt:    scheduledAt,
 			CreatedAt:      time.Now(),
 		}
-		if err := db.Create(&task).Error; err != nil {
+		task.ExpiresAt = taskExpiry(ttl, sub, task)
+		// The task and its outbox row are stored together, the task gets queued even if redis is down right now
+		err = h.DB.Transaction(func(tx *gorm.DB) error {
+			if idempotencyKey != "" {
+				if err := claimIdempotencyKey(tx, sub.ID, idempotencyKey, payloadHash(body), task.ID, h.IdempotencyWindow); err != nil {
+					return err
+				}
+			}
+			if err := helpers.AssignSequence(tx, &task, sub); err != nil {
+				return err
+			}
+			if err := tx.Create(&task).Error; err != nil {
+				return err
+			}
+			return helpers.AddToOutbox(tx, task)
+		})
+		var repeat *idempotentRepeat
+		if errors.As(err, &repeat) {
+			c.Header("Idempotent-Replayed", "true")
+			c.JSON(http.StatusAccepted, gin.H{"status": "duplicate", "task_id": repeat.taskID})
+			return
+		}
+		if errors.Is(err, errIdempotencyMismatch) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used with a different payload"})
+			return
+		}
+		if err != nil {
 			log.Printf("Failed to create Webhook Task: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 			return
 		}
 
-		// Create Asynq client
-		client := asynq.NewClient(asynq.RedisClientOpt{
-			Addr:      redisOpt.Addr,
-			Username:  redisOpt.Username,
-			Password:  redisOpt.Password,
-			TLSConfig: redisOpt.TLSConfig, // if present, will be included
-			DB:        redisOpt.DB,
-		})
-		defer client.Close()
+		// Enqueue Job, left to the relay of the worker if it fails
+		helpers.DispatchFromOutbox(h.DB, h.QueueClient, h.Inspector, task, sub)
 
-		// Enqueue Job
-		jobPayload, _ := json.Marshal(task)
-		job := asynq.NewTask("webhook:deliver", jobPayload)
-
-		_, err = client.Enqueue(job,
-			asynq.Queue("default"),
-			asynq.MaxRetry(5),
-			asynq.Timeout(10*time.Second),
-		)
-		if err != nil {
-			log.Printf("Failed to enqueue task: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue task"})
+		if scheduledAt != nil {
+			c.JSON(http.StatusAccepted, gin.H{"status": "scheduled", "task_id": task.ID, "deliver_at": scheduledAt})
 			return
 		}
-
 		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "task_id": task.ID})
 	}
 }
@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// how long dropping the cached subscription and notifying the owner may take
+const notifyTimeout = 10 * time.Second
+
+// subscriptionDisabledEvent is sent to the notification URL of a subscription when it gets disabled
+type subscriptionDisabledEvent struct {
+	Type                string     `json:"type"`
+	SubscriptionID      uuid.UUID  `json:"subscription_id"`
+	TargetURL           string     `json:"target_url"`
+	Reason              string     `json:"reason"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since"`
+	DisabledAt          time.Time  `json:"disabled_at"`
+}
+
+// recordHealth keeps track of the failure streak of a subscription and disables it
+// once it has been failing for too long
+func (wd *WorkerDependencies) recordHealth(sub models.Subscription, result attemptResult) {
+	if !result.failed() {
+		// any success ends the streak
+		err := wd.DB.Model(&models.Subscription{}).
+			Where("id = ? AND consecutive_failures > 0", sub.ID).
+			Updates(map[string]interface{}{"consecutive_failures": 0, "failing_since": nil}).Error
+		if err != nil {
+			log.Printf("Failed to reset failure streak of subscription %s: %v", sub.ID, err)
+		}
+		return
+	}
+
+	// extend the streak and read it back
+	var health models.Subscription
+	err := wd.DB.Model(&health).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "consecutive_failures"}, {Name: "failing_since"}, {Name: "status"}}}).
+		Where("id = ?", sub.ID).
+		Updates(map[string]interface{}{
+			"consecutive_failures": gorm.Expr("consecutive_failures + 1"),
+			"failing_since":        gorm.Expr("COALESCE(failing_since, ?)", time.Now()),
+		}).Error
+	if err != nil {
+		log.Printf("Failed to record failure of subscription %s: %v", sub.ID, err)
+		return
+	}
+	if health.Status != models.SubscriptionActive {
+		return
+	}
+
+	reason := ""
+	streak := wd.Config.AutoDisableFailureStreak
+	window := wd.Config.AutoDisableFailureWindow
+	switch {
+	case streak > 0 && health.ConsecutiveFailures >= streak:
+		reason = fmt.Sprintf("%d consecutive failed deliveries", health.ConsecutiveFailures)
+	case window > 0 && health.FailingSince != nil && time.Since(*health.FailingSince) >= window:
+		reason = fmt.Sprintf("deliveries failing since %s", health.FailingSince.Format(time.RFC3339))
+	default:
+		return
+	}
+
+	wd.disableSubscription(sub, health, reason)
+}
+
+// disableSubscription turns a subscription off and notifies its owner
+func (wd *WorkerDependencies) disableSubscription(sub models.Subscription, health models.Subscription, reason string) {
+	// not the task context, it is already done when the failure that got us here was a timeout
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	now := time.Now()
+	result := wd.DB.Model(&models.Subscription{}).
+		Where("id = ? AND status = ?", sub.ID, models.SubscriptionActive).
+		Updates(map[string]interface{}{
+			"status":          models.SubscriptionDisabled,
+			"disabled_at":     now,
+			"disabled_reason": reason,
+		})
+	if result.Error != nil {
+		log.Printf("Failed to disable subscription %s: %v", sub.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return // another worker got there first
+	}
+	log.Printf("Disabled subscription %s: %s", sub.ID, reason)
+
+	// drop the cached copy so every worker sees the new status
+	wd.RedisClient.Del(ctx, fmt.Sprintf("subscription:%s", sub.ID))
+
+	if sub.NotificationURL == "" {
+		return
+	}
+	wd.notify(ctx, sub, subscriptionDisabledEvent{
+		Type:                "subscription.disabled",
+		SubscriptionID:      sub.ID,
+		TargetURL:           sub.TargetURL,
+		Reason:              reason,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+		FailingSince:        health.FailingSince,
+		DisabledAt:          now,
+	})
+}
+
+// notify POSTs an event to the notification URL of a subscription, signed like a regular delivery
+func (wd *WorkerDependencies) notify(ctx context.Context, sub models.Subscription, event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal notification for subscription %s: %v", sub.ID, err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.NotificationURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to create notification for subscription %s: %v", sub.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signDelivery(req, sub, uuid.New().String(), time.Now(), body)
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to notify owner of subscription %s: %v", sub.ID, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Notification for subscription %s was answered with HTTP %d", sub.ID, resp.StatusCode)
+	}
+}
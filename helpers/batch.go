@@ -0,0 +1,341 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+)
+
+const (
+	// how long the first task of a batch waits for the others when the subscription doesn't say
+	defaultBatchMaxWait = 5 * time.Second
+
+	// largest batch a subscription can ask for
+	maxBatchSize = 500
+)
+
+// WebhookBatch is the payload of a batch delivery task
+type WebhookBatch struct {
+	ID             uuid.UUID            `json:"id"`
+	SubscriptionID uuid.UUID            `json:"subscription_id"`
+	Tasks          []models.WebhookTask `json:"tasks"` // oldest first
+}
+
+// batchItem is one webhook in the JSON array POSTed to the receiver
+type batchItem struct {
+	ID        uuid.UUID       `json:"id"`
+	EventType string          `json:"event_type,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// tasks waiting for the next batch of a subscription, oldest first
+func batchKey(subID uuid.UUID) string {
+	return fmt.Sprintf("batch:%s", subID)
+}
+
+// set while a flush of the subscription's batch is scheduled
+func batchFlushKey(subID uuid.UUID) string {
+	return fmt.Sprintf("batch:%s:flush", subID)
+}
+
+// flushTask turns the collected tasks of the subscription into batches when it runs
+func flushTask(subID uuid.UUID) *asynq.Task {
+	return asynq.NewTask(TaskTypeFlushBatch, []byte(subID.String()))
+}
+
+// batching tells whether the subscription gets its deliveries in batches.
+// Ordered subscriptions deliver one task at a time, so they are never batched.
+func batching(sub models.Subscription) bool {
+	return sub.BatchSize > 1 && !sub.Ordered
+}
+
+func batchMaxWait(sub models.Subscription) time.Duration {
+	if sub.BatchMaxWait > 0 {
+		return time.Duration(sub.BatchMaxWait) * time.Second
+	}
+	return defaultBatchMaxWait
+}
+
+// bufferTask adds a task to the next batch of its subscription
+func (wd *WorkerDependencies) bufferTask(ctx context.Context, sub models.Subscription, task models.WebhookTask, payload []byte) error {
+	size, err := wd.RedisClient.RPush(ctx, batchKey(sub.ID), payload).Result()
+	if err != nil {
+		log.Printf("Failed to add task %s to a batch: %v", task.ID, err)
+		return &deferError{reason: "batch unavailable", delay: 30 * time.Second}
+	}
+
+	if err := wd.scheduleFlush(ctx, sub, size); err != nil {
+		log.Printf("Failed to schedule batch flush for subscription %s: %v", sub.ID, err)
+
+		// nothing may flush the task, take it out again and come back later
+		removed, _ := wd.RedisClient.LRem(ctx, batchKey(sub.ID), 1, payload).Result()
+		if removed == 0 {
+			return nil // an earlier flush picked it up already
+		}
+		return &deferError{reason: "batch flush not scheduled", delay: 30 * time.Second}
+	}
+
+	log.Printf("Added %s to the next batch of subscription %s", task.ID, sub.ID)
+	return nil
+}
+
+// scheduleFlush flushes full batches right away, otherwise the first task of a batch schedules a flush after the max wait
+func (wd *WorkerDependencies) scheduleFlush(ctx context.Context, sub models.Subscription, size int64) error {
+	flush := flushTask(sub.ID)
+	if size >= int64(sub.BatchSize) {
+		_, err := wd.QueueClient.Enqueue(flush, asynq.Queue(DefaultQueue))
+		return err
+	}
+
+	wait := batchMaxWait(sub)
+	scheduled, err := wd.RedisClient.SetNX(ctx, batchFlushKey(sub.ID), 1, wait+time.Minute).Result()
+	if err != nil || !scheduled {
+		return err
+	}
+	if _, err := wd.QueueClient.Enqueue(flush, asynq.Queue(DefaultQueue), asynq.ProcessIn(wait)); err != nil {
+		wd.RedisClient.Del(ctx, batchFlushKey(sub.ID))
+		return err
+	}
+	return nil
+}
+
+// flushBatch turns the tasks collected for a subscription into batch deliveries
+func (wd *WorkerDependencies) flushBatch(ctx context.Context, task *asynq.Task) error {
+	subID, err := uuid.Parse(string(task.Payload()))
+	if err != nil {
+		return fmt.Errorf("invalid flush payload: %w", asynq.SkipRetry)
+	}
+	sub, err := wd.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	// tasks added from now on schedule the next flush
+	wd.RedisClient.Del(ctx, batchFlushKey(subID))
+
+	size := max(sub.BatchSize, 1)
+	for {
+		items, err := wd.RedisClient.LPopCount(ctx, batchKey(subID), size).Result()
+		if err == redis.Nil || (err == nil && len(items) == 0) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := wd.enqueueBatch(ctx, sub, items); err != nil {
+			// put the tasks back in front, the retry of the flush picks them up
+			back := make([]interface{}, len(items))
+			for i, item := range items {
+				back[len(items)-1-i] = item
+			}
+			wd.RedisClient.LPush(ctx, batchKey(subID), back...)
+			return err
+		}
+	}
+}
+
+// enqueueBatch queues one batch delivery for the given task payloads
+func (wd *WorkerDependencies) enqueueBatch(ctx context.Context, sub models.Subscription, items []string) error {
+	batch := WebhookBatch{ID: uuid.New(), SubscriptionID: sub.ID}
+	for _, item := range items {
+		var task models.WebhookTask
+		if err := json.Unmarshal([]byte(item), &task); err != nil {
+			log.Printf("Dropping invalid task from the batch of subscription %s: %v", sub.ID, err)
+			continue
+		}
+		batch.Tasks = append(batch.Tasks, task)
+	}
+	if len(batch.Tasks) == 0 {
+		return nil
+	}
+
+	// batching was turned off in the meantime, deliver the tasks one by one
+	if !batching(sub) {
+		for _, task := range batch.Tasks {
+			if err := EnqueueWebhookTask(ctx, wd.QueueClient, wd.Inspector, task, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(batch.Tasks))
+	for i := range batch.Tasks {
+		batch.Tasks[i].BatchID = &batch.ID
+		ids[i] = batch.Tasks[i].ID
+	}
+	if err := EnqueueWebhookBatch(wd.QueueClient, batch, sub); err != nil {
+		return err
+	}
+
+	if err := wd.DB.Model(&models.WebhookTask{}).Where("id IN ?", ids).Update("batch_id", batch.ID).Error; err != nil {
+		log.Printf("Failed to record batch %s on its tasks: %v", batch.ID, err)
+	}
+	log.Printf("Queued batch %s of %d tasks for subscription %s", batch.ID, len(batch.Tasks), sub.ID)
+	return nil
+}
+
+// processBatchTask delivers a batch in a single request, every task of the batch gets the outcome in its delivery log
+func (wd *WorkerDependencies) processBatchTask(ctx context.Context, task *asynq.Task) error {
+	var batch WebhookBatch
+	if err := json.Unmarshal(task.Payload(), &batch); err != nil {
+		log.Printf("Failed to unmarshal batch payload: %v", err)
+		return err
+	}
+	if len(batch.Tasks) == 0 {
+		return nil
+	}
+
+	sub, err := wd.getSubscription(ctx, batch.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	// Cancelled and expired tasks are left out, the others still go
+	live := batch.Tasks[:0]
+	for _, webhookTask := range batch.Tasks {
+		if wd.cancelled(ctx, webhookTask.ID) {
+			continue
+		}
+		if expired(webhookTask) {
+			wd.expireTask(webhookTask, sub)
+			continue
+		}
+		live = append(live, webhookTask)
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	batch.Tasks = live
+
+	// Disabled subscriptions don't get deliveries, keep the batch in the dead-letter queue for later
+	if sub.Status == models.SubscriptionDisabled {
+		log.Printf("Subscription %s is disabled, dead-lettering batch %s", sub.ID, batch.ID)
+		wd.markFinished(models.TaskStateDead, batch.Tasks...)
+		return fmt.Errorf("subscription is disabled: %w", asynq.SkipRetry)
+	}
+
+	// Paused subscriptions keep their tasks, they are queued again one by one on resume
+	if sub.Status == models.SubscriptionPaused {
+		remaining := batch.Tasks[:0]
+		for _, webhookTask := range batch.Tasks {
+			held, err := wd.holdTask(webhookTask)
+			if err != nil {
+				log.Printf("Failed to hold task %s: %v", webhookTask.ID, err)
+				return &deferError{reason: "subscription is paused", delay: 30 * time.Second}
+			}
+			if !held {
+				remaining = append(remaining, webhookTask)
+			}
+		}
+		if len(remaining) == 0 {
+			log.Printf("Subscription %s is paused, holding batch %s", sub.ID, batch.ID)
+			return nil
+		}
+		// resumed in the meantime, deliver what wasn't held
+		batch.Tasks = remaining
+	}
+
+	// Wait while the endpoint or the subscription's limits can't take another delivery
+	slot, err := wd.waitForCapacity(ctx, sub)
+	if err != nil {
+		return err
+	}
+	defer wd.releaseSlot(sub.ID, slot)
+
+	body, err := batchBody(batch)
+	if err != nil {
+		return fmt.Errorf("batch marshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	// Deliver and record the attempt on every task of the batch
+	retryCount, _ := asynq.GetRetryCount(ctx)
+	wd.markDelivering(batch.Tasks...)
+	result := deliver(ctx, sub, batch.ID.String(), body)
+	interrupted := errors.Is(ctx.Err(), context.Canceled)
+	ctx, cancel := bookkeepingContext(ctx)
+	defer cancel()
+
+	// the worker is shutting down, the endpoint isn't to blame
+	if result.failed() && interrupted {
+		log.Printf("Delivery of batch %s was interrupted, not counting it as a failure", batch.ID)
+		return result.err
+	}
+	for _, webhookTask := range batch.Tasks {
+		logAttempt(wd.DB, webhookTask, sub, retryCount+1, result)
+	}
+	wd.recordBreaker(ctx, sub.ID, result)
+	wd.recordHealth(sub, result)
+
+	if result.failed() {
+		log.Printf("Delivery failed for batch %s: %s", batch.ID, result.ErrorMessage)
+		err := wd.deliveryFailure(ctx, sub, batch.Tasks[0], result)
+		if finalAttempt(ctx, err) {
+			wd.markFinished(failedState(result), batch.Tasks...)
+		} else {
+			wd.markRetrying(batch.Tasks...)
+		}
+		return err
+	}
+
+	log.Printf("Delivery successful for batch %s (%d tasks)", batch.ID, len(batch.Tasks))
+	wd.markFinished(models.TaskStateSucceeded, batch.Tasks...)
+	return nil
+}
+
+// batchBody is the JSON array POSTed for a batch
+func batchBody(batch WebhookBatch) ([]byte, error) {
+	items := make([]batchItem, len(batch.Tasks))
+	for i, task := range batch.Tasks {
+		items[i] = batchItem{
+			ID:        task.ID,
+			EventType: task.EventType,
+			CreatedAt: task.CreatedAt,
+			Payload:   json.RawMessage(task.Payload),
+		}
+	}
+	return json.Marshal(items)
+}
+
+// retryPolicyTask is the webhook task whose subscription and age drive the retries of an asynq task,
+// the oldest task for batches
+func retryPolicyTask(task *asynq.Task) (models.WebhookTask, error) {
+	var webhookTask models.WebhookTask
+	switch task.Type() {
+	case TaskTypeDeliver:
+		err := json.Unmarshal(task.Payload(), &webhookTask)
+		return webhookTask, err
+	case TaskTypeDeliverBatch:
+		var batch WebhookBatch
+		if err := json.Unmarshal(task.Payload(), &batch); err != nil {
+			return webhookTask, err
+		}
+		if len(batch.Tasks) == 0 {
+			return webhookTask, errors.New("empty batch")
+		}
+		return batch.Tasks[0], nil
+	default:
+		return webhookTask, fmt.Errorf("no retry policy for task type %s", task.Type())
+	}
+}
+
+// ValidateBatching checks the batching fields of a subscription
+func ValidateBatching(sub models.Subscription) error {
+	if sub.BatchSize < 0 || sub.BatchSize > maxBatchSize {
+		return fmt.Errorf("batch_size must be between 0 and %d", maxBatchSize)
+	}
+	if sub.BatchMaxWait < 0 {
+		return errors.New("batch_max_wait can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// how long a half-open probe may take before another one is let through
+	breakerProbeTimeout = 15 * time.Second
+
+	// breaker state of a subscription that stopped receiving deliveries is dropped after a while
+	breakerStateTTL = 7 * 24 * time.Hour
+)
+
+// decides whether a delivery may go through, returns 0 to allow it or the milliseconds to wait
+var breakerAllowScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], 'state')
+local now = tonumber(ARGV[1])
+if not state or state == 'closed' then
+	return 0
+end
+if state == 'open' then
+	local retry_at = tonumber(redis.call('HGET', KEYS[1], 'retry_at'))
+	if now < retry_at then
+		return retry_at - now
+	end
+	-- cooldown is over, let a single probe through
+	redis.call('HSET', KEYS[1], 'state', 'half_open', 'probe_until', now + tonumber(ARGV[2]))
+	return 0
+end
+-- half open, only one probe in flight at a time
+local probe_until = tonumber(redis.call('HGET', KEYS[1], 'probe_until') or '0')
+if now < probe_until then
+	return probe_until - now
+end
+redis.call('HSET', KEYS[1], 'probe_until', now + tonumber(ARGV[2]))
+return 0
+`)
+
+// counts a failure and opens the breaker on reaching the threshold or when a probe fails
+var breakerFailureScript = redis.NewScript(`
+local failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+local state = redis.call('HGET', KEYS[1], 'state') or 'closed'
+if state == 'half_open' or (state == 'closed' and failures >= tonumber(ARGV[2])) then
+	redis.call('HSET', KEYS[1], 'state', 'open', 'opened_at', ARGV[1], 'retry_at', tonumber(ARGV[1]) + tonumber(ARGV[3]))
+	redis.call('HDEL', KEYS[1], 'probe_until')
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return failures
+`)
+
+func breakerKey(subID uuid.UUID) string {
+	return fmt.Sprintf("breaker:%s", subID)
+}
+
+// breakerWait returns how long deliveries to the subscription have to wait for the breaker, 0 if they may go through
+func (wd *WorkerDependencies) breakerWait(ctx context.Context, subID uuid.UUID) time.Duration {
+	if wd.Config.BreakerFailureThreshold <= 0 {
+		return 0 // breaker disabled
+	}
+
+	waitMs, err := breakerAllowScript.Run(ctx, wd.RedisClient, []string{breakerKey(subID)},
+		time.Now().UnixMilli(), breakerProbeTimeout.Milliseconds()).Int64()
+	if err != nil {
+		// don't stop deliveries because the breaker can't be read
+		log.Printf("Failed to check circuit breaker for subscription %s: %v", subID, err)
+		return 0
+	}
+	return time.Duration(waitMs) * time.Millisecond
+}
+
+// recordBreaker updates the breaker with the outcome of a delivery attempt.
+// Only signs of a broken endpoint count: no response at all or a 5xx.
+func (wd *WorkerDependencies) recordBreaker(ctx context.Context, subID uuid.UUID, result attemptResult) {
+	if wd.Config.BreakerFailureThreshold <= 0 {
+		return
+	}
+
+	var err error
+	switch {
+	case !result.failed() || (result.HTTPStatus > 0 && result.HTTPStatus < 500):
+		// the endpoint is up, close the breaker
+		err = wd.RedisClient.Del(ctx, breakerKey(subID)).Err()
+	case result.ErrorCategory == models.ErrorCategoryRequest:
+		// never reached the endpoint
+		return
+	default:
+		var failures int64
+		failures, err = breakerFailureScript.Run(ctx, wd.RedisClient, []string{breakerKey(subID)},
+			time.Now().UnixMilli(), wd.Config.BreakerFailureThreshold,
+			wd.Config.BreakerCooldown.Milliseconds(), breakerStateTTL.Milliseconds()).Int64()
+		if err == nil && failures == int64(wd.Config.BreakerFailureThreshold) {
+			log.Printf("Circuit breaker opened for subscription %s after %d consecutive failures", subID, failures)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to update circuit breaker for subscription %s: %v", subID, err)
+	}
+}
+
+// GetBreakerState reads the circuit breaker of a subscription
+func GetBreakerState(ctx context.Context, rdb *redis.Client, subID uuid.UUID) (models.BreakerState, error) {
+	state := models.BreakerState{SubscriptionID: subID, State: models.BreakerClosed}
+
+	fields, err := rdb.HGetAll(ctx, breakerKey(subID)).Result()
+	if err != nil {
+		return state, err
+	}
+
+	if val, ok := fields["state"]; ok {
+		state.State = val
+	}
+	state.ConsecutiveFailures, _ = strconv.Atoi(fields["failures"])
+	state.OpenedAt = parseMillis(fields["opened_at"])
+	if state.State != models.BreakerClosed {
+		state.RetryAt = parseMillis(fields["retry_at"])
+	}
+	return state, nil
+}
+
+// parseMillis converts a unix milliseconds field, nil when missing
+func parseMillis(val string) *time.Time {
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.UnixMilli(ms)
+	return &t
+}
@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// a cancelled task can't come back later than this, even from its last retry
+const cancelledTTL = 30 * 24 * time.Hour
+
+func cancelledKey(taskID uuid.UUID) string {
+	return fmt.Sprintf("webhook:cancelled:%s", taskID)
+}
+
+// MarkCancelled tells the workers to drop a task wherever it shows up again: retries, batches or a cancelled run
+func MarkCancelled(ctx context.Context, rdb *redis.Client, taskID uuid.UUID) error {
+	return rdb.Set(ctx, cancelledKey(taskID), 1, cancelledTTL).Err()
+}
+
+// cancelled tells whether a task was cancelled through the API
+func (wd *WorkerDependencies) cancelled(ctx context.Context, taskID uuid.UUID) bool {
+	n, err := wd.RedisClient.Exists(ctx, cancelledKey(taskID)).Result()
+	if err != nil {
+		log.Printf("Failed to check cancellation of task %s: %v", taskID, err)
+		return false
+	}
+	return n > 0
+}
@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+// validateTargetURL rejects target URLs that can never be delivered to
+func validateTargetURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+// classifyStatus tells whether a non-2xx response is worth retrying.
+// 4xx means the receiver rejected the request itself, except for request timeout and throttling.
+func classifyStatus(statusCode int) string {
+	if statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests {
+		return models.FailurePermanent
+	}
+	return models.FailureRetryable
+}
+
+// classifyError tells whether a failed request is worth retrying.
+// Certificate verification errors won't fix themselves, every other network error may.
+func classifyError(err error) string {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+
+	if errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidCertErr) {
+		return models.FailurePermanent
+	}
+	return models.FailureRetryable
+}
+
+// categorizeError tells at which stage a request without a response failed
+func categorizeError(err error) string {
+	var dnsErr *net.DNSError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return models.ErrorCategoryDNS
+	case errors.As(err, &alertErr) || errors.As(err, &recordErr) || classifyError(err) == models.FailurePermanent:
+		return models.ErrorCategoryTLS
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return models.ErrorCategoryTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return models.ErrorCategoryConnect
+	default:
+		return models.ErrorCategoryNetwork
+	}
+}
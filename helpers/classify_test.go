@@ -0,0 +1,67 @@
+package helpers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{400, models.FailurePermanent},
+		{401, models.FailurePermanent},
+		{404, models.FailurePermanent},
+		{410, models.FailurePermanent},
+		{422, models.FailurePermanent},
+		{408, models.FailureRetryable},
+		{429, models.FailureRetryable},
+		{500, models.FailureRetryable},
+		{502, models.FailureRetryable},
+		{503, models.FailureRetryable},
+		{301, models.FailureRetryable},
+	}
+
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status); got != tt.want {
+			t.Errorf("classifyStatus(%d) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	// errors come out of http.Client.Do wrapped in a *url.Error
+	wrap := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://example.com/hook", Err: err}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"unknown authority", wrap(x509.UnknownAuthorityError{}), models.FailurePermanent},
+		{"hostname mismatch", wrap(x509.HostnameError{Host: "example.com"}), models.FailurePermanent},
+		{"expired certificate", wrap(x509.CertificateInvalidError{Reason: x509.Expired}), models.FailurePermanent},
+		{"verification failed", wrap(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), models.FailurePermanent},
+		{"dns", wrap(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), models.FailureRetryable},
+		{"connection refused", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), models.FailureRetryable},
+		{"timeout", wrap(context.DeadlineExceeded), models.FailureRetryable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// a slot is given back after this long even if its worker died mid delivery, well past the task timeout
+const slotLease = 30 * time.Second
+
+// semaphore of deliveries in flight, members are slots scored by the time their lease runs out.
+// Returns 1 when a slot was taken, 0 when all of them are in use.
+var acquireSlotScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+func inflightKey(subID uuid.UUID) string {
+	return fmt.Sprintf("inflight:%s", subID)
+}
+
+// concurrencyLimit is the number of deliveries to a subscription that may be in flight at once, 0 for no limit
+func (wd *WorkerDependencies) concurrencyLimit(sub models.Subscription) int {
+	if sub.MaxConcurrency > 0 {
+		return sub.MaxConcurrency
+	}
+	return wd.Config.SubscriptionConcurrency
+}
+
+// acquireSlot takes one of the subscription's delivery slots, ok is false when they are all in use
+func (wd *WorkerDependencies) acquireSlot(ctx context.Context, sub models.Subscription) (slot string, ok bool) {
+	limit := wd.concurrencyLimit(sub)
+	if limit <= 0 {
+		return "", true
+	}
+
+	slot = uuid.New().String()
+	taken, err := acquireSlotScript.Run(ctx, wd.RedisClient, []string{inflightKey(sub.ID)},
+		limit, slot, slotLease.Milliseconds()).Int()
+	if err != nil {
+		// don't stop deliveries because the semaphore can't be read
+		log.Printf("Failed to acquire delivery slot for subscription %s: %v", sub.ID, err)
+		return "", true
+	}
+	return slot, taken == 1
+}
+
+// releaseSlot gives a slot back once the delivery is over
+func (wd *WorkerDependencies) releaseSlot(subID uuid.UUID, slot string) {
+	if slot == "" {
+		return
+	}
+	// the task context may already be done when the delivery timed out
+	if err := wd.RedisClient.ZRem(context.Background(), inflightKey(subID), slot).Err(); err != nil {
+		log.Printf("Failed to release delivery slot for subscription %s: %v", subID, err)
+	}
+}
+
+// slotRetryDelay is how long a task waits for a free slot, with some jitter so waiting tasks don't all come back together
+func slotRetryDelay() time.Duration {
+	return time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))
+}
+
+// ValidateConcurrency checks the concurrency limit of a subscription
+func ValidateConcurrency(sub models.Subscription) error {
+	if sub.MaxConcurrency < 0 {
+		return errors.New("max_concurrency can not be negative")
+	}
+	return nil
+}
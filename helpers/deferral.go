@@ -0,0 +1,40 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// deferError postpones a task without attempting the delivery.
+// It is not counted as a failure, so the task keeps all of its retries.
+// asynq checks the retry count before looking at IsFailure, tasks get a spare retry
+// so a deferral on the last attempt isn't archived (see queueMaxRetry).
+type deferError struct {
+	reason string
+	delay  time.Duration
+}
+
+func (e *deferError) Error() string {
+	return fmt.Sprintf("delivery deferred for %s: %s", e.delay, e.reason)
+}
+
+// retryAfterError is a failed attempt for which the receiver told us when to come back
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", e.err, e.delay)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// isFailure is the asynq IsFailure func, deferred tasks don't use up their retries
+func isFailure(err error) bool {
+	var deferErr *deferError
+	return !errors.As(err, &deferErr)
+}
@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+// longest part of a response body kept on a delivery log
+const maxLoggedResponseBody = 4 << 10
+
+// how long a receiver has to answer a delivery
+const deliveryTimeout = 10 * time.Second
+
+// attemptResult describes the outcome of a single delivery attempt
+type attemptResult struct {
+	Status          string
+	HTTPStatus      int // 0 when no response was received
+	ErrorMessage    string
+	FailureClass    string
+	ErrorCategory   string
+	Duration        time.Duration
+	ResponseHeaders map[string]string
+	ResponseBody    string
+
+	err           error         // short error returned to asynq
+	retryAfter    time.Duration // wait asked for by the receiver
+	hasRetryAfter bool
+}
+
+func (r attemptResult) failed() bool {
+	return r.Status == "Failed"
+}
+
+// deliver POSTs a body to the target URL of the subscription and reports what happened
+func deliver(ctx context.Context, sub models.Subscription, msgID string, body []byte) attemptResult {
+	// Invalid target URLs are never going to work
+	if err := validateTargetURL(sub.TargetURL); err != nil {
+		return requestFailure(fmt.Errorf("invalid target URL: %w", err))
+	}
+
+	// The attempt ends well before the task times out, so asynq always gets the error built from its outcome
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	// Prepare HTTP client and request
+	client := &http.Client{Timeout: deliveryTimeout}
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.TargetURL, bytes.NewReader(body))
+	if err != nil {
+		return requestFailure(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Sign the delivery so the receiver can verify it came from us
+	signDelivery(req, sub, msgID, time.Now(), body)
+
+	// Send HTTP request to subscription url
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return attemptResult{
+			Status:        "Failed",
+			ErrorMessage:  err.Error(),
+			FailureClass:  classifyError(err),
+			ErrorCategory: categorizeError(err),
+			Duration:      time.Since(start),
+			err:           err,
+		}
+	}
+	defer resp.Body.Close()
+
+	// Keep the start of the body, it is usually enough to see why a delivery failed
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedResponseBody))
+	result := attemptResult{
+		Status:          "Success",
+		HTTPStatus:      resp.StatusCode,
+		Duration:        time.Since(start),
+		ResponseHeaders: flattenHeaders(resp.Header),
+		ResponseBody:    string(respBody),
+	}
+
+	// Handle HTTP response
+	if resp.StatusCode >= 300 {
+		result.Status = "Failed"
+		result.FailureClass = classifyStatus(resp.StatusCode)
+		result.ErrorCategory = models.ErrorCategoryHTTP
+		result.ErrorMessage = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(respBody))
+		result.err = fmt.Errorf("Non-2xx status code: %d", resp.StatusCode)
+		result.retryAfter, result.hasRetryAfter = retryAfter(resp)
+	}
+	return result
+}
+
+// requestFailure is the result of a request that could not even be sent
+func requestFailure(err error) attemptResult {
+	return attemptResult{
+		Status:        "Failed",
+		ErrorMessage:  err.Error(),
+		FailureClass:  models.FailurePermanent,
+		ErrorCategory: models.ErrorCategoryRequest,
+		err:           err,
+	}
+}
+
+// flattenHeaders joins repeated header values so they fit in a flat JSON object
+func flattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		flat[name] = strings.Join(values, ", ")
+	}
+	return flat
+}
@@ -0,0 +1,37 @@
+package helpers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+)
+
+// expired tells whether a task outlived its TTL
+func expired(task models.WebhookTask) bool {
+	return task.ExpiresAt != nil && !time.Now().Before(*task.ExpiresAt)
+}
+
+// expireTask ends a task that outlived its TTL without attempting it
+func (wd *WorkerDependencies) expireTask(task models.WebhookTask, sub models.Subscription) {
+	log.Printf("Task %s expired at %s, not delivering it", task.ID, task.ExpiresAt.Format(time.RFC3339))
+
+	logEntry := models.DeliveryLog{
+		ID:             uuid.New(),
+		WebhookTaskID:  task.ID,
+		SubscriptionID: task.SubscriptionID,
+		TargetURL:      sub.TargetURL,
+		Status:         models.DeliveryExpired,
+		ErrorMessage:   fmt.Sprintf("expired at %s", task.ExpiresAt.Format(time.RFC3339)),
+		RedeliveryOf:   task.RedeliveryOf,
+		BatchID:        task.BatchID,
+		CreatedAt:      time.Now(),
+	}
+	if err := wd.DB.Create(&logEntry).Error; err != nil {
+		log.Printf("Failed to log expiry of task %s: %v", task.ID, err)
+	}
+
+	wd.markFinished(models.TaskStateExpired, task)
+}
@@ -0,0 +1,22 @@
+package helpers
+
+import (
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+// holdTask parks a task while its subscription is paused, it is queued again on resume.
+// Returns false when the subscription is no longer paused and the task should be delivered.
+func (wd *WorkerDependencies) holdTask(task models.WebhookTask) (bool, error) {
+	// the status is checked against the database (not the cache) under a share lock,
+	// so a concurrent resume either waits for this update or makes it a no-op
+	result := wd.DB.Model(&models.WebhookTask{}).
+		Where("id = ?", task.ID).
+		Where("EXISTS (SELECT 1 FROM subscriptions WHERE id = ? AND status = ? FOR SHARE)", task.SubscriptionID, models.SubscriptionPaused).
+		Update("held_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
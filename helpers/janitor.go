@@ -17,6 +17,7 @@ func StartLogClean(db *gorm.DB) {
 	// trigger cleanup when the time finishes
 	for range ticker.C {
 		cleanupLogs(db)
+		cleanupIdempotencyKeys(db)
 	}
 }
 
@@ -31,3 +32,14 @@ func cleanupLogs(db *gorm.DB) {
 	}
 	log.Printf("Cleaned up %d old delivery logs.", result.RowsAffected)
 }
+
+func cleanupIdempotencyKeys(db *gorm.DB) {
+	// keys past their window are no longer looked at
+	result := db.Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{})
+
+	if result.Error != nil {
+		log.Printf("Failed to cleanup idempotency keys: %v", result.Error)
+		return
+	}
+	log.Printf("Cleaned up %d expired idempotency keys.", result.RowsAffected)
+}
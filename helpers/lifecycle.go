@@ -0,0 +1,148 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+)
+
+// markDelivering records the start of an attempt on the tasks
+func (wd *WorkerDependencies) markDelivering(tasks ...models.WebhookTask) {
+	wd.updateTasks(tasks, map[string]interface{}{
+		"state":           models.TaskStateDelivering,
+		"attempts":        gorm.Expr("attempts + 1"),
+		"last_attempt_at": time.Now(),
+		"next_retry_at":   nil,
+	})
+}
+
+// markRetrying records a failed attempt that asynq is going to retry, retryDelay fills in the time
+func (wd *WorkerDependencies) markRetrying(tasks ...models.WebhookTask) {
+	wd.updateTasks(tasks, map[string]interface{}{"state": models.TaskStateRetrying})
+}
+
+// markFinished records the final state of the tasks, the next task of an ordered subscription may go
+func (wd *WorkerDependencies) markFinished(state string, tasks ...models.WebhookTask) {
+	wd.updateTasks(tasks, map[string]interface{}{
+		"state":         state,
+		"next_retry_at": nil,
+		"completed_at":  gorm.Expr("COALESCE(completed_at, ?)", time.Now()),
+	})
+}
+
+// recordNextRetry stores when asynq is going to retry a failed delivery or batch
+func (wd *WorkerDependencies) recordNextRetry(task *asynq.Task, delay time.Duration) {
+	wd.updateTasks(webhookTasks(task), map[string]interface{}{"next_retry_at": time.Now().Add(delay)})
+}
+
+// recordArchived is the asynq ErrorHandler. Tasks archived without an outcome recorded by the worker,
+// e.g. after errors outside the delivery used up their retries, are marked dead.
+// An ordered task left unfinished would block the tasks behind it for good.
+func (wd *WorkerDependencies) recordArchived(ctx context.Context, task *asynq.Task, err error) {
+	if !finalAttempt(ctx, err) {
+		return
+	}
+	tasks := webhookTasks(task)
+	if len(tasks) == 0 {
+		return
+	}
+	ids := make([]uuid.UUID, len(tasks))
+	for i, webhookTask := range tasks {
+		ids[i] = webhookTask.ID
+	}
+
+	result := wd.DB.Model(&models.WebhookTask{}).
+		Where("id IN ? AND completed_at IS NULL", ids).
+		Updates(map[string]interface{}{
+			"state":         models.TaskStateDead,
+			"next_retry_at": nil,
+			"completed_at":  time.Now(),
+		})
+	if result.Error != nil {
+		log.Printf("Failed to record archived tasks %v: %v", ids, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Recorded %d archived tasks as dead after: %v", result.RowsAffected, err)
+	}
+}
+
+// webhookTasks are the webhook tasks carried by a delivery or batch task
+func webhookTasks(task *asynq.Task) []models.WebhookTask {
+	switch task.Type() {
+	case TaskTypeDeliver:
+		var webhookTask models.WebhookTask
+		if err := json.Unmarshal(task.Payload(), &webhookTask); err != nil {
+			return nil
+		}
+		return []models.WebhookTask{webhookTask}
+	case TaskTypeDeliverBatch:
+		var batch WebhookBatch
+		if err := json.Unmarshal(task.Payload(), &batch); err != nil {
+			return nil
+		}
+		return batch.Tasks
+	}
+	return nil
+}
+
+// failedState is the final state of a task whose delivery failed for good
+func failedState(result attemptResult) string {
+	if result.FailureClass == models.FailurePermanent {
+		return models.TaskStateFailed
+	}
+	return models.TaskStateDead
+}
+
+func (wd *WorkerDependencies) updateTasks(tasks []models.WebhookTask, updates map[string]interface{}) {
+	if len(tasks) == 0 {
+		return
+	}
+	ids := make([]uuid.UUID, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	// a cancellation is final, even when an attempt was already in progress
+	err := wd.DB.Model(&models.WebhookTask{}).
+		Where("id IN ? AND state <> ?", ids, models.TaskStateCancelled).
+		Updates(updates).Error
+	if err != nil {
+		log.Printf("Failed to update state of tasks %v: %v", ids, err)
+	}
+}
+
+// MigrateTaskLifecycle adds the lifecycle columns to webhook_tasks. Tasks stored before they existed would look queued
+// forever and the reconciler would queue them again, so they get a final state from their delivery logs in the same
+// transaction: succeeded after a successful attempt, dead after failed ones. Those whose logs were already cleaned up
+// are taken as delivered.
+func MigrateTaskLifecycle(db *gorm.DB) error {
+	// new databases and migrated ones are left to AutoMigrate
+	if !db.Migrator().HasTable(&models.WebhookTask{}) || db.Migrator().HasColumn(&models.WebhookTask{}, "State") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&models.WebhookTask{}); err != nil {
+			return err
+		}
+		result := tx.Exec(`UPDATE webhook_tasks SET
+			state = CASE
+				WHEN EXISTS (SELECT 1 FROM delivery_logs l WHERE l.webhook_task_id = webhook_tasks.id AND l.status = 'Success') THEN ?
+				WHEN EXISTS (SELECT 1 FROM delivery_logs l WHERE l.webhook_task_id = webhook_tasks.id) THEN ?
+				ELSE ? END,
+			attempts = (SELECT COUNT(*) FROM delivery_logs l WHERE l.webhook_task_id = webhook_tasks.id),
+			last_attempt_at = (SELECT MAX(l.created_at) FROM delivery_logs l WHERE l.webhook_task_id = webhook_tasks.id),
+			completed_at = COALESCE((SELECT MAX(l.created_at) FROM delivery_logs l WHERE l.webhook_task_id = webhook_tasks.id), webhook_tasks.created_at)`,
+			models.TaskStateSucceeded, models.TaskStateDead, models.TaskStateSucceeded)
+		if result.Error != nil {
+			return result.Error
+		}
+		log.Printf("Recorded a final state on %d tasks stored before task states existed", result.RowsAffected)
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package helpers
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"gorm.io/gorm"
+)
+
+// AssignSequence gives a task of an ordered subscription its place in line, other tasks are left alone.
+// It has to run in the transaction creating the task: the counter row stays locked until the commit,
+// so tasks become visible to the worker in sequence order.
+func AssignSequence(tx *gorm.DB, task *models.WebhookTask, sub models.Subscription) error {
+	if !sub.Ordered {
+		return nil
+	}
+
+	task.OrderingKey = orderingKey(sub, task.Payload)
+	return tx.Raw(`INSERT INTO ordering_sequences (subscription_id, ordering_key, last_sequence) VALUES (?, ?, 1)
+		ON CONFLICT (subscription_id, ordering_key) DO UPDATE SET last_sequence = ordering_sequences.last_sequence + 1
+		RETURNING last_sequence`, sub.ID, task.OrderingKey).Scan(&task.Sequence).Error
+}
+
+// orderingKey reads the subscription's ordering key field from a payload, tasks without it share the empty key
+func orderingKey(sub models.Subscription, payload string) string {
+	if sub.OrderingKey == "" {
+		return ""
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return ""
+	}
+	for _, field := range strings.Split(sub.OrderingKey, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = obj[field]; !ok {
+			return ""
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s
+	}
+	key, _ := json.Marshal(value)
+	return string(key)
+}
+
+// orderingBlocked tells whether an earlier task with the same ordering key is still waiting for delivery
+func (wd *WorkerDependencies) orderingBlocked(task models.WebhookTask) (bool, error) {
+	var blocked bool
+	err := wd.DB.Raw(`SELECT EXISTS (SELECT 1 FROM webhook_tasks
+		WHERE subscription_id = ? AND ordering_key = ? AND sequence > 0 AND sequence < ? AND completed_at IS NULL)`,
+		task.SubscriptionID, task.OrderingKey, task.Sequence).Scan(&blocked).Error
+	return blocked, err
+}
+
+// orderingRetryDelay is how long a task waits before checking again whether it is at the head of the line
+func orderingRetryDelay() time.Duration {
+	return 5*time.Second + time.Duration(rand.Int63n(int64(5*time.Second)))
+}
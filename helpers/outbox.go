@@ -0,0 +1,197 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how often the relay looks for tasks left in the outbox
+	outboxRelayInterval = time.Second
+
+	// outbox rows queued per transaction
+	outboxRelayBatch = 100
+
+	// how long the API waits for redis when it queues a task itself
+	dispatchTimeout = 2 * time.Second
+)
+
+// AddToOutbox records tasks to be queued, it has to run in the transaction creating them
+// so a task is never stored without being queued eventually
+func AddToOutbox(tx *gorm.DB, tasks ...models.WebhookTask) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	now := time.Now()
+	msgs := make([]models.OutboxMessage, len(tasks))
+	for i, task := range tasks {
+		msgs[i] = models.OutboxMessage{WebhookTaskID: task.ID, CreatedAt: now}
+	}
+	return tx.Create(&msgs).Error
+}
+
+// DispatchFromOutbox queues a task right away instead of waiting for the relay.
+// When it fails the task stays in the outbox and the relay queues it later. It returns false then,
+// callers with more tasks leave them to the relay as well instead of waiting on redis for each one.
+func DispatchFromOutbox(db *gorm.DB, client *asynq.Client, inspector *asynq.Inspector, task models.WebhookTask, sub models.Subscription) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dispatchTimeout)
+	defer cancel()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// skip the row if the relay is queueing it right now
+		var msg models.OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("webhook_task_id = ?", task.ID).
+			Take(&msg).Error
+		if err != nil {
+			return err
+		}
+		if err := EnqueueWebhookTask(ctx, client, inspector, task, sub); err != nil {
+			return err
+		}
+		return tx.Delete(&msg).Error
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Task %s left in the outbox for the relay: %v", task.ID, err)
+		return false
+	}
+	return true
+}
+
+// StartOutboxRelay queues the tasks left in the outbox, e.g. while redis was down or after the API crashed
+func StartOutboxRelay(db *gorm.DB, redisOpt asynq.RedisClientOpt) {
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+
+	ticker := time.NewTicker(outboxRelayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// keep going while there are full batches
+		for {
+			relayed, err := relayOutbox(db, client, inspector)
+			if err != nil {
+				log.Printf("Failed to relay outbox: %v", err)
+				break
+			}
+			if relayed < outboxRelayBatch {
+				break
+			}
+		}
+	}
+}
+
+// relayOutbox queues one batch of outbox rows and deletes them, returns how many were queued
+func relayOutbox(db *gorm.DB, client *asynq.Client, inspector *asynq.Inspector) (int, error) {
+	relayed := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// rows locked by another relay or by the API are left to them
+		var msgs []models.OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Order("id").
+			Limit(outboxRelayBatch).
+			Find(&msgs).Error
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+
+		tasks, subs, err := loadOutboxTasks(tx, msgs)
+		if err != nil {
+			return err
+		}
+
+		done := make([]uint64, 0, len(msgs))
+		for _, msg := range msgs {
+			task, ok := tasks[msg.WebhookTaskID]
+			if !ok {
+				log.Printf("Dropping outbox row %d, task %s no longer exists", msg.ID, msg.WebhookTaskID)
+				done = append(done, msg.ID)
+				continue
+			}
+			sub, ok := subs[task.SubscriptionID]
+			if !ok {
+				log.Printf("Dropping outbox row %d, subscription %s no longer exists", msg.ID, task.SubscriptionID)
+				done = append(done, msg.ID)
+				continue
+			}
+			if finished(task) {
+				log.Printf("Dropping outbox row %d, task %s is already %s", msg.ID, task.ID, task.State)
+				done = append(done, msg.ID)
+				continue
+			}
+
+			if err := EnqueueWebhookTask(context.Background(), client, inspector, task, sub); err != nil {
+				log.Printf("Failed to queue task %s from the outbox: %v", task.ID, err)
+				tx.Model(&msg).Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": err.Error()})
+				if errors.Is(err, asynq.ErrTaskIDConflict) {
+					continue // the run holding the ID is about to finish, try again next round
+				}
+				break // most likely redis is unavailable, the rest waits for the next round
+			}
+			done = append(done, msg.ID)
+			relayed++
+		}
+
+		if len(done) == 0 {
+			return nil
+		}
+		return tx.Delete(&models.OutboxMessage{}, done).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	if relayed > 0 {
+		log.Printf("Relayed %d tasks from the outbox", relayed)
+	}
+	return relayed, nil
+}
+
+// loadOutboxTasks fetches the tasks of outbox rows and their subscriptions, by ID
+func loadOutboxTasks(tx *gorm.DB, msgs []models.OutboxMessage) (map[uuid.UUID]models.WebhookTask, map[uuid.UUID]models.Subscription, error) {
+	taskIDs := make([]uuid.UUID, len(msgs))
+	for i, msg := range msgs {
+		taskIDs[i] = msg.WebhookTaskID
+	}
+	var taskList []models.WebhookTask
+	if err := tx.Where("id IN ?", taskIDs).Find(&taskList).Error; err != nil {
+		return nil, nil, err
+	}
+
+	tasks := make(map[uuid.UUID]models.WebhookTask, len(taskList))
+	subIDs := make([]uuid.UUID, 0, len(taskList))
+	for _, task := range taskList {
+		tasks[task.ID] = task
+		subIDs = append(subIDs, task.SubscriptionID)
+	}
+
+	var subList []models.Subscription
+	if len(subIDs) > 0 {
+		if err := tx.Where("id IN ?", subIDs).Find(&subList).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	subs := make(map[uuid.UUID]models.Subscription, len(subList))
+	for _, sub := range subList {
+		subs[sub.ID] = sub
+	}
+	return tasks, subs, nil
+}
+
+// finished tells whether a task reached a final state, it is never queued again
+func finished(task models.WebhookTask) bool {
+	switch task.State {
+	case models.TaskStateSucceeded, models.TaskStateFailed, models.TaskStateDead, models.TaskStateCancelled, models.TaskStateExpired:
+		return true
+	}
+	return false
+}
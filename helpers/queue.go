@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// TaskTypeDeliver is the asynq task type of a webhook delivery
+const TaskTypeDeliver = "webhook:deliver"
+
+// TaskTypeDeliverBatch is the asynq task type of a batch of webhooks delivered in a single request
+const TaskTypeDeliverBatch = "webhook:deliver_batch"
+
+// TaskTypeFlushBatch is the asynq task type that turns the collected tasks of a subscription into batches
+const TaskTypeFlushBatch = "webhook:flush_batch"
+
+// DefaultQueue is the asynq queue deliveries are processed from
+const DefaultQueue = "default"
+
+// taskTimeout leaves room around the attempt for waiting on capacity and recording the outcome
+const taskTimeout = deliveryTimeout + 2*bookkeepingTimeout
+
+// AsynqRedisOpt converts parsed redis options (handles Upstash rediss://) into asynq connection options
+func AsynqRedisOpt(opt *redis.Options) asynq.RedisClientOpt {
+	return asynq.RedisClientOpt{
+		Addr:      opt.Addr,
+		Username:  opt.Username,
+		Password:  opt.Password,
+		TLSConfig: opt.TLSConfig, // if present, will be included
+		DB:        opt.DB,
+	}
+}
+
+// EnqueueWebhookTask queues a webhook task for delivery by the worker, following the subscription's retry policy.
+// A task already in the queue under its ID counts as queued, unless it is running right now.
+func EnqueueWebhookTask(ctx context.Context, client *asynq.Client, inspector *asynq.Inspector, task models.WebhookTask, sub models.Subscription) error {
+	jobPayload, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	job := asynq.NewTask(TaskTypeDeliver, jobPayload)
+
+	opts := []asynq.Option{
+		asynq.TaskID(task.ID.String()), // the asynq task can be found from the webhook task
+		asynq.Queue(DefaultQueue),
+		asynq.MaxRetry(queueMaxRetry(sub)),
+		asynq.Timeout(taskTimeout),
+	}
+	// scheduled deliveries wait in asynq's scheduled set until it is time
+	if task.ScheduledAt != nil && task.ScheduledAt.After(time.Now()) {
+		opts = append(opts, asynq.ProcessAt(*task.ScheduledAt))
+	}
+
+	_, err = client.EnqueueContext(ctx, job, opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return taskIDConflict(inspector, task)
+	}
+	return err
+}
+
+// taskIDConflict decides whether the asynq task already queued under the ID of a webhook task takes care of it.
+// A waiting one delivers it, an archived or completed one already ended it. Only an active run may be about
+// to finish without delivering, e.g. after holding the task, so that one is worth another try later.
+func taskIDConflict(inspector *asynq.Inspector, task models.WebhookTask) error {
+	info, err := inspector.GetTaskInfo(DefaultQueue, task.ID.String())
+	if err != nil {
+		return fmt.Errorf("task %s already queued, can't tell its state: %w", task.ID, err)
+	}
+	if info.State == asynq.TaskStateActive {
+		return fmt.Errorf("task %s is %s in the queue: %w", task.ID, info.State, asynq.ErrTaskIDConflict)
+	}
+	return nil
+}
+
+// EnqueueWebhookBatch queues a batch of webhook tasks for delivery in a single request, following the subscription's retry policy
+func EnqueueWebhookBatch(client *asynq.Client, batch WebhookBatch, sub models.Subscription) error {
+	jobPayload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	job := asynq.NewTask(TaskTypeDeliverBatch, jobPayload)
+
+	// the batch ID lets the reconciler find the batch its tasks ride on
+	_, err = client.Enqueue(job,
+		asynq.Queue(DefaultQueue),
+		asynq.TaskID(batch.ID.String()),
+		asynq.MaxRetry(queueMaxRetry(sub)),
+		asynq.Timeout(taskTimeout),
+	)
+	return err
+}
@@ -0,0 +1,71 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// token bucket shared by all workers, returns 0 when a token was taken or the milliseconds until the next one.
+// It uses the redis clock so workers with skewed clocks agree on the refill.
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return wait
+`)
+
+func rateLimitKey(subID uuid.UUID) string {
+	return fmt.Sprintf("ratelimit:%s", subID)
+}
+
+// rateLimitWait takes a token from the subscription's bucket, returns how long to wait when there is none
+func (wd *WorkerDependencies) rateLimitWait(ctx context.Context, sub models.Subscription) time.Duration {
+	if sub.RateLimit <= 0 {
+		return 0 // unlimited
+	}
+
+	burst := sub.RateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(sub.RateLimit))
+	}
+
+	waitMs, err := rateLimitScript.Run(ctx, wd.RedisClient, []string{rateLimitKey(sub.ID)}, sub.RateLimit, burst).Int64()
+	if err != nil {
+		// don't stop deliveries because the bucket can't be read
+		log.Printf("Failed to check rate limit for subscription %s: %v", sub.ID, err)
+		return 0
+	}
+	return time.Duration(waitMs) * time.Millisecond
+}
+
+// ValidateRateLimit checks the rate limit fields of a subscription
+func ValidateRateLimit(sub models.Subscription) error {
+	if sub.RateLimit < 0 || sub.RateLimitBurst < 0 {
+		return errors.New("rate limit values can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/config"
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// younger tasks may still be on their way into the queue
+	reconcileGracePeriod = 5 * time.Minute
+
+	// tasks checked against the queue per run
+	reconcileBatch = 500
+)
+
+// counters published at /debug/vars of the worker's health server
+var (
+	reconcilerRuns          = expvar.NewInt("reconciler_runs")
+	reconcilerRepairedTasks = expvar.NewInt("reconciler_repaired_tasks")
+)
+
+// StartReconciler periodically queues again the unfinished tasks that are missing from asynq,
+// e.g. after a redis flush, eviction or failover
+func StartReconciler(db *gorm.DB, rdb *redis.Client, redisOpt asynq.RedisClientOpt, cfg *config.Config) {
+	if cfg.ReconcileInterval <= 0 {
+		log.Println("Reconciler is turned off")
+		return
+	}
+
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+
+	ticker := time.NewTicker(cfg.ReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reconcileTasks(db, rdb, client, inspector, cfg.ReconcileLookback)
+	}
+}
+
+// reconciliation remembers what one run already looked up in redis
+type reconciliation struct {
+	rdb       *redis.Client
+	client    *asynq.Client
+	inspector *asynq.Inspector
+	batches   map[uuid.UUID]bool               // batch ID -> batch task still in asynq
+	buffered  map[uuid.UUID]map[uuid.UUID]bool // subscription ID -> tasks in its batch buffer
+}
+
+// reconcileTasks finds unfinished tasks without an asynq task and puts them back into the outbox
+func reconcileTasks(db *gorm.DB, rdb *redis.Client, client *asynq.Client, inspector *asynq.Inspector, lookback time.Duration) {
+	reconcilerRuns.Add(1)
+
+	r := &reconciliation{
+		rdb:       rdb,
+		client:    client,
+		inspector: inspector,
+		batches:   map[uuid.UUID]bool{},
+		buffered:  map[uuid.UUID]map[uuid.UUID]bool{},
+	}
+
+	// Candidates: unfinished, not held or waiting in the outbox, walked in pages until the window is done
+	now := time.Now()
+	checked, repaired := 0, 0
+	var last *models.WebhookTask
+pages:
+	for {
+		query := db.Where("state IN ?", []string{models.TaskStateQueued, models.TaskStateDelivering, models.TaskStateRetrying}).
+			Where("held_at IS NULL").
+			Where("created_at BETWEEN ? AND ?", now.Add(-lookback), now.Add(-reconcileGracePeriod)).
+			Where("NOT EXISTS (SELECT 1 FROM outbox_messages WHERE outbox_messages.webhook_task_id = webhook_tasks.id)")
+		if last != nil {
+			query = query.Where("(created_at, id) > (?, ?)", last.CreatedAt, last.ID)
+		}
+
+		var candidates []models.WebhookTask
+		if err := query.Order("created_at, id").Limit(reconcileBatch).Find(&candidates).Error; err != nil {
+			log.Printf("Reconciler failed to fetch tasks: %v", err)
+			break
+		}
+
+		for _, task := range candidates {
+			lost, err := r.lost(task)
+			if err != nil {
+				log.Printf("Reconciler failed to look up task %s: %v", task.ID, err)
+				break pages
+			}
+			if lost && r.repair(db, task) {
+				repaired++
+			}
+		}
+
+		checked += len(candidates)
+		if len(candidates) < reconcileBatch {
+			break
+		}
+		last = &candidates[len(candidates)-1]
+	}
+
+	reconcilerRepairedTasks.Add(int64(repaired))
+	if repaired > 0 {
+		log.Printf("Reconciler repaired %d of %d checked tasks", repaired, checked)
+	}
+}
+
+// lost tells whether nothing in redis is going to deliver the task: no asynq task of its own,
+// no batch task carrying it and no place in its subscription's batch buffer
+func (r *reconciliation) lost(task models.WebhookTask) (bool, error) {
+	if task.BatchID != nil {
+		found, err := r.batchQueued(*task.BatchID)
+		return !found, err
+	}
+
+	found, err := r.queued(task.ID.String())
+	if found || err != nil {
+		return false, err
+	}
+
+	buffered, err := r.bufferedTasks(task.SubscriptionID)
+	if err != nil {
+		return false, err
+	}
+	return !buffered[task.ID], nil
+}
+
+// queued tells whether asynq still has the task with the given ID
+func (r *reconciliation) queued(id string) (bool, error) {
+	_, err := r.inspector.GetTaskInfo(DefaultQueue, id)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// batchQueued is queued for batch tasks, a batch is looked up once per run
+func (r *reconciliation) batchQueued(batchID uuid.UUID) (bool, error) {
+	if found, ok := r.batches[batchID]; ok {
+		return found, nil
+	}
+	found, err := r.queued(batchID.String())
+	if err != nil {
+		return false, err
+	}
+	r.batches[batchID] = found
+	return found, nil
+}
+
+// bufferedTasks reads the IDs of the tasks waiting for the next batch of a subscription, once per run.
+// A buffer without a scheduled flush, e.g. after a worker died between buffering a task and scheduling the flush,
+// gets flushed now.
+func (r *reconciliation) bufferedTasks(subID uuid.UUID) (map[uuid.UUID]bool, error) {
+	if ids, ok := r.buffered[subID]; ok {
+		return ids, nil
+	}
+	ctx := context.Background()
+	items, err := r.rdb.LRange(ctx, batchKey(subID), 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		scheduled, err := r.rdb.Exists(ctx, batchFlushKey(subID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		// full batches are flushed without the key, a flush too many finds an empty buffer
+		if scheduled == 0 {
+			if _, err := r.client.Enqueue(flushTask(subID), asynq.Queue(DefaultQueue)); err != nil {
+				return nil, err
+			}
+			log.Printf("Reconciler flushed the batch buffer of subscription %s, no flush was scheduled", subID)
+		}
+	}
+	ids := make(map[uuid.UUID]bool, len(items))
+	for _, item := range items {
+		var task models.WebhookTask
+		if json.Unmarshal([]byte(item), &task) == nil {
+			ids[task.ID] = true
+		}
+	}
+	r.buffered[subID] = ids
+	return ids, nil
+}
+
+// repair puts a lost task back into the outbox. The worker records the outcome before asynq drops a task,
+// so reading the state again tells a lost task from one that just finished.
+func (r *reconciliation) repair(db *gorm.DB, task models.WebhookTask) bool {
+	repaired := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current models.WebhookTask
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, "id = ?", task.ID).Error; err != nil {
+			return err
+		}
+		if current.CompletedAt != nil || current.HeldAt != nil {
+			return nil
+		}
+		if !equalBatch(current.BatchID, task.BatchID) {
+			return nil // flushed into a batch in the meantime, the next run checks that one
+		}
+
+		// the lost batch doesn't come back, the task is delivered on its own
+		if current.BatchID != nil {
+			if err := tx.Model(&current).Update("batch_id", nil).Error; err != nil {
+				return err
+			}
+			current.BatchID = nil
+		}
+		if err := AddToOutbox(tx, current); err != nil {
+			return err
+		}
+		log.Printf("Reconciler queued task %s again, it was %s without an asynq task", task.ID, current.State)
+		repaired = true
+		return nil
+	})
+	if err != nil {
+		log.Printf("Reconciler failed to repair task %s: %v", task.ID, err)
+		return false
+	}
+	return repaired
+}
+
+func equalBatch(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
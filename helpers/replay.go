@@ -0,0 +1,194 @@
+package helpers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how often the worker looks for replay jobs nobody is running
+	replayPollInterval = time.Second
+
+	// a running job whose worker wasn't heard from for this long is taken over
+	replayStaleAfter = 30 * time.Second
+
+	// tasks of a replay job selected at a time
+	replayBatch = 100
+)
+
+// RedeliverTask creates a copy of a past task linked to the original and queues it for delivery through the outbox
+func RedeliverTask(db *gorm.DB, client *asynq.Client, inspector *asynq.Inspector, original models.WebhookTask, sub models.Subscription) (models.WebhookTask, error) {
+	// always link to the first task, so redeliveries of redeliveries stay grouped together
+	originalID := original.ID
+	if original.RedeliveryOf != nil {
+		originalID = *original.RedeliveryOf
+	}
+
+	task := models.WebhookTask{
+		ID:             uuid.New(),
+		SubscriptionID: original.SubscriptionID,
+		EventType:      original.EventType,
+		Payload:        original.Payload,
+		RedeliveryOf:   &originalID,
+		CreatedAt:      time.Now(),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := AssignSequence(tx, &task, sub); err != nil {
+			return err
+		}
+		if err := tx.Create(&task).Error; err != nil {
+			return err
+		}
+		return AddToOutbox(tx, task)
+	})
+	if err != nil {
+		return task, err
+	}
+
+	DispatchFromOutbox(db, client, inspector, task, sub)
+	return task, nil
+}
+
+// ReplayTasks selects the tasks a replay job still has to re-enqueue, the ones after its cursor.
+// Tasks created after the job, e.g. its own redeliveries, are never part of it.
+func ReplayTasks(db *gorm.DB, job models.ReplayJob) *gorm.DB {
+	to := job.To
+	if job.CreatedAt.Before(to) {
+		to = job.CreatedAt
+	}
+	query := db.Model(&models.WebhookTask{}).
+		Where("subscription_id = ? AND created_at >= ? AND created_at < ?", job.SubscriptionID, job.From, to)
+
+	if job.StatusFilter == "failed" {
+		// dead-lettered, and no redelivery of it was delivered or is still on its way.
+		// Tasks still being retried are left alone, the logs may already be cleaned up.
+		query = query.
+			Where("state IN ?", []string{models.TaskStateFailed, models.TaskStateDead}).
+			Where("NOT EXISTS (SELECT 1 FROM webhook_tasks r WHERE r.redelivery_of = webhook_tasks.id AND r.state NOT IN ?)",
+				[]string{models.TaskStateFailed, models.TaskStateDead, models.TaskStateCancelled, models.TaskStateExpired})
+	}
+
+	if job.CursorTaskID != nil {
+		query = query.Where("(created_at, id) > (?, ?)", job.CursorCreatedAt, job.CursorTaskID)
+	}
+	return query
+}
+
+// StartReplayRunner runs the replay jobs created through the API. A worker claims a job and keeps it
+// while it makes progress, a job whose worker died is taken over by another one where it stopped.
+func StartReplayRunner(db *gorm.DB, redisOpt asynq.RedisClientOpt) {
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+
+	owner := uuid.New().String()
+
+	ticker := time.NewTicker(replayPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			job, err := claimReplayJob(db, owner)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to claim a replay job: %v", err)
+				break
+			}
+			go runReplay(db, client, inspector, job)
+		}
+	}
+}
+
+// claimReplayJob takes a running job nobody works on, claiming it is its first heartbeat
+func claimReplayJob(db *gorm.DB, owner string) (models.ReplayJob, error) {
+	var job models.ReplayJob
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND (COALESCE(owner, '') = '' OR updated_at < ?)", models.ReplayStatusRunning, time.Now().Add(-replayStaleAfter)).
+			Order("created_at").
+			Take(&job).Error
+		if err != nil {
+			return err
+		}
+		if job.Owner != "" {
+			log.Printf("Taking over replay %s, its worker stopped after %d tasks", job.ID, job.Enqueued)
+		}
+		job.Owner = owner
+		return tx.Model(&job).Update("owner", owner).Error
+	})
+	return job, err
+}
+
+// runReplay re-enqueues the tasks of a replay job at the job's rate. Every step moves the cursor,
+// which is also the heartbeat telling other workers the job is still running.
+func runReplay(db *gorm.DB, client *asynq.Client, inspector *asynq.Inspector, job models.ReplayJob) {
+	var sub models.Subscription
+	if err := db.First(&sub, "id = ?", job.SubscriptionID).Error; err != nil {
+		finishReplay(db, job, models.ReplayStatusFailed, "subscription not found")
+		return
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(job.Rate))
+	defer ticker.Stop()
+
+	for {
+		var tasks []models.WebhookTask
+		if err := ReplayTasks(db, job).Order("created_at, id").Limit(replayBatch).Find(&tasks).Error; err != nil {
+			log.Printf("Replay %s failed to select tasks: %v", job.ID, err)
+			finishReplay(db, job, models.ReplayStatusFailed, err.Error())
+			return
+		}
+		if len(tasks) == 0 {
+			finishReplay(db, job, models.ReplayStatusCompleted, "")
+			log.Printf("Replay %s completed, %d tasks re-enqueued", job.ID, job.Enqueued)
+			return
+		}
+
+		for _, original := range tasks {
+			<-ticker.C
+
+			if _, err := RedeliverTask(db, client, inspector, original, sub); err != nil {
+				log.Printf("Replay %s failed on task %s: %v", job.ID, original.ID, err)
+				finishReplay(db, job, models.ReplayStatusFailed, err.Error())
+				return
+			}
+
+			createdAt, taskID := original.CreatedAt, original.ID
+			job.Enqueued++
+			job.CursorCreatedAt, job.CursorTaskID = &createdAt, &taskID
+			result := db.Model(&job).Where("owner = ?", job.Owner).Updates(map[string]interface{}{
+				"enqueued":          job.Enqueued,
+				"cursor_created_at": createdAt,
+				"cursor_task_id":    taskID,
+			})
+			if result.Error != nil {
+				log.Printf("Failed to record progress of replay %s: %v", job.ID, result.Error)
+			} else if result.RowsAffected == 0 {
+				log.Printf("Replay %s was taken over by another worker, stopping", job.ID)
+				return
+			}
+		}
+	}
+}
+
+func finishReplay(db *gorm.DB, job models.ReplayJob, status, errMsg string) {
+	now := time.Now()
+	err := db.Model(&job).Where("owner = ?", job.Owner).Updates(map[string]interface{}{
+		"status":       status,
+		"error":        errMsg,
+		"completed_at": &now,
+	}).Error
+	if err != nil {
+		log.Printf("Failed to update replay job %s: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,94 @@
+package helpers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+	"github.com/hibiken/asynq"
+)
+
+// Retry policy defaults, used when a subscription leaves the fields empty
+const (
+	defaultMaxAttempts     = 6 // first attempt + 5 retries
+	defaultBackoffInterval = 30 * time.Second
+)
+
+// MaxRetry returns how many times a task of the subscription may be retried after the first attempt
+func MaxRetry(sub models.Subscription) int {
+	if sub.MaxAttempts <= 0 {
+		return defaultMaxAttempts - 1
+	}
+	return sub.MaxAttempts - 1
+}
+
+// queueMaxRetry is the retry count asynq gets for a task of the subscription, one more than the policy allows.
+// asynq archives a task that used up its retries even when it was only deferred, the spare retry keeps a task
+// deferred on its last attempt in the queue. The worker archives the last failure of the policy itself.
+func queueMaxRetry(sub models.Subscription) int {
+	return MaxRetry(sub) + 1
+}
+
+// PolicyMaxRetry turns the retry count of an asynq task back into the one of the retry policy
+func PolicyMaxRetry(queueMaxRetry int) int {
+	return max(queueMaxRetry-1, 0)
+}
+
+// RetryDelay returns how long to wait before the retry that follows the n-th failure (n starts at 0)
+func RetryDelay(sub models.Subscription, n int, e error, t *asynq.Task) time.Duration {
+	interval := time.Duration(sub.BackoffInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultBackoffInterval
+	}
+
+	var delay time.Duration
+	switch sub.BackoffStrategy {
+	case models.BackoffLinear:
+		delay = time.Duration(n+1) * interval
+	case models.BackoffFixed:
+		delay = interval
+		if len(sub.BackoffSchedule) > 0 {
+			// walk through the schedule, then keep using its last value
+			delay = time.Duration(sub.BackoffSchedule[min(n, len(sub.BackoffSchedule)-1)]) * time.Second
+		}
+	default:
+		delay = asynq.DefaultRetryDelayFunc(n, e, t) // Exponential backoff - builtin function
+	}
+
+	if sub.MaxBackoff > 0 && delay > time.Duration(sub.MaxBackoff)*time.Second {
+		delay = time.Duration(sub.MaxBackoff) * time.Second
+	}
+	return delay
+}
+
+// RetryDeadline returns the time after which a task of the subscription is no longer retried.
+// Scheduled tasks count from their delivery time.
+func RetryDeadline(sub models.Subscription, task models.WebhookTask) (time.Time, bool) {
+	if sub.RetryDeadline <= 0 {
+		return time.Time{}, false
+	}
+	start := task.CreatedAt
+	if task.ScheduledAt != nil {
+		start = *task.ScheduledAt
+	}
+	return start.Add(time.Duration(sub.RetryDeadline) * time.Second), true
+}
+
+// ValidateRetryPolicy checks the retry policy fields of a subscription
+func ValidateRetryPolicy(sub models.Subscription) error {
+	switch sub.BackoffStrategy {
+	case "", models.BackoffExponential, models.BackoffLinear, models.BackoffFixed:
+	default:
+		return errors.New("backoff_strategy must be one of exponential, linear or fixed")
+	}
+
+	if sub.MaxAttempts < 0 || sub.BackoffInterval < 0 || sub.MaxBackoff < 0 || sub.RetryDeadline < 0 || sub.DefaultTTL < 0 {
+		return errors.New("retry policy values can not be negative")
+	}
+	for _, seconds := range sub.BackoffSchedule {
+		if seconds < 0 {
+			return errors.New("backoff_schedule values can not be negative")
+		}
+	}
+	return nil
+}
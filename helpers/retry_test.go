@@ -0,0 +1,125 @@
+package helpers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		sub  models.Subscription
+		n    int
+		want time.Duration
+	}{
+		{
+			name: "linear first retry",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffLinear, BackoffInterval: 10},
+			n:    0,
+			want: 10 * time.Second,
+		},
+		{
+			name: "linear third retry",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffLinear, BackoffInterval: 10},
+			n:    2,
+			want: 30 * time.Second,
+		},
+		{
+			name: "linear default interval",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffLinear},
+			n:    1,
+			want: 2 * defaultBackoffInterval,
+		},
+		{
+			name: "fixed interval",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffFixed, BackoffInterval: 45},
+			n:    4,
+			want: 45 * time.Second,
+		},
+		{
+			name: "fixed schedule",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffFixed, BackoffSchedule: []int{5, 60, 300}},
+			n:    1,
+			want: time.Minute,
+		},
+		{
+			name: "fixed schedule repeats its last value",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffFixed, BackoffSchedule: []int{5, 60, 300}},
+			n:    7,
+			want: 5 * time.Minute,
+		},
+		{
+			name: "capped by max backoff",
+			sub:  models.Subscription{BackoffStrategy: models.BackoffLinear, BackoffInterval: 60, MaxBackoff: 90},
+			n:    3,
+			want: 90 * time.Second,
+		},
+		{
+			name: "exponential capped by max backoff",
+			sub:  models.Subscription{MaxBackoff: 10},
+			n:    5,
+			want: 10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RetryDelay(tt.sub, tt.n, errors.New("delivery failed"), nil)
+			if got != tt.want {
+				t.Errorf("RetryDelay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayExponential(t *testing.T) {
+	// asynq's default backoff adds jitter, check that it grows
+	sub := models.Subscription{BackoffStrategy: models.BackoffExponential}
+	first := RetryDelay(sub, 0, errors.New("delivery failed"), nil)
+	later := RetryDelay(sub, 4, errors.New("delivery failed"), nil)
+	if first <= 0 || later <= first {
+		t.Errorf("RetryDelay() = %s after the first failure and %s after the fifth, want a growing delay", first, later)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	created := time.Date(2025, 4, 26, 12, 0, 0, 0, time.UTC)
+	scheduled := created.Add(time.Hour)
+
+	if _, ok := RetryDeadline(models.Subscription{}, models.WebhookTask{CreatedAt: created}); ok {
+		t.Error("RetryDeadline() without a deadline on the subscription, want none")
+	}
+
+	sub := models.Subscription{RetryDeadline: 600}
+	if got, _ := RetryDeadline(sub, models.WebhookTask{CreatedAt: created}); !got.Equal(created.Add(10 * time.Minute)) {
+		t.Errorf("RetryDeadline() = %s, want 10 minutes after creation", got)
+	}
+	if got, _ := RetryDeadline(sub, models.WebhookTask{CreatedAt: created, ScheduledAt: &scheduled}); !got.Equal(scheduled.Add(10 * time.Minute)) {
+		t.Errorf("RetryDeadline() = %s, want 10 minutes after the delivery time", got)
+	}
+}
+
+func TestQueueMaxRetry(t *testing.T) {
+	tests := []struct {
+		sub  models.Subscription
+		want int
+	}{
+		{models.Subscription{}, defaultMaxAttempts},
+		{models.Subscription{MaxAttempts: 1}, 1},
+		{models.Subscription{MaxAttempts: 10}, 10},
+	}
+
+	for _, tt := range tests {
+		got := queueMaxRetry(tt.sub)
+		if got != tt.want {
+			t.Errorf("queueMaxRetry(max_attempts %d) = %d, want %d", tt.sub.MaxAttempts, got, tt.want)
+		}
+		// the spare retry is left out wherever the policy is shown
+		if PolicyMaxRetry(got) != MaxRetry(tt.sub) {
+			t.Errorf("PolicyMaxRetry(%d) = %d, want %d", got, PolicyMaxRetry(got), MaxRetry(tt.sub))
+		}
+	}
+}
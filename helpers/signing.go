@@ -0,0 +1,107 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Miku7676/webhook-delivery-service/models"
+)
+
+// Headers attached to every outgoing delivery (default scheme)
+const (
+	HeaderWebhookID        = "X-Webhook-ID"
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+// Headers attached to every outgoing delivery (Standard Webhooks scheme)
+const (
+	HeaderStandardWebhookID        = "webhook-id"
+	HeaderStandardWebhookTimestamp = "webhook-timestamp"
+	HeaderStandardWebhookSignature = "webhook-signature"
+)
+
+// prefix of Standard Webhooks secrets, the rest of the secret is the base64 encoded key
+const standardSecretPrefix = "whsec_"
+
+// signDelivery sets the identity and signature headers on an outgoing request
+// according to the signature scheme of the subscription
+func signDelivery(req *http.Request, sub models.Subscription, msgID string, sentAt time.Time, body []byte) {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+
+	if sub.SignatureScheme == models.SignatureSchemeStandardWebhooks {
+		// net/http canonicalizes header names, which is fine since headers are case insensitive
+		req.Header.Set(HeaderStandardWebhookID, msgID)
+		req.Header.Set(HeaderStandardWebhookTimestamp, timestamp)
+		if signature := SignStandardPayload(sub.Secret, msgID, timestamp, body); signature != "" {
+			req.Header.Set(HeaderStandardWebhookSignature, "v1,"+signature)
+		}
+		return
+	}
+
+	req.Header.Set(HeaderWebhookID, msgID)
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	if sub.Secret != "" {
+		req.Header.Set(HeaderWebhookSignature, "sha256="+SignPayload(sub.Secret, msgID, timestamp, body))
+	}
+}
+
+// SignPayload computes the hex encoded HMAC-SHA256 of the signed content for a delivery.
+// Receivers recompute this with their copy of the secret to verify the request.
+func SignPayload(secret, msgID, timestamp string, body []byte) string {
+	return hex.EncodeToString(signContent([]byte(secret), msgID, timestamp, body))
+}
+
+// SignStandardPayload computes the base64 encoded signature used by the Standard Webhooks scheme.
+// The key is the base64 decoded part of a whsec_ secret, subscriptions are only saved with valid ones.
+// It returns an empty signature for an invalid secret.
+func SignStandardPayload(secret, msgID, timestamp string, body []byte) string {
+	key, err := decodeStandardSecret(secret)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(signContent(key, msgID, timestamp, body))
+}
+
+// GenerateStandardSecret returns a new random secret in the whsec_<base64> format
+func GenerateStandardSecret() (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return standardSecretPrefix + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ValidateStandardSecret checks that a secret can be used with the Standard Webhooks scheme
+func ValidateStandardSecret(secret string) error {
+	_, err := decodeStandardSecret(secret)
+	return err
+}
+
+func decodeStandardSecret(secret string) ([]byte, error) {
+	if !strings.HasPrefix(secret, standardSecretPrefix) {
+		return nil, errors.New("secret must start with " + standardSecretPrefix)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, standardSecretPrefix))
+	if err != nil {
+		return nil, errors.New("secret must be base64 encoded after the " + standardSecretPrefix + " prefix")
+	}
+	return key, nil
+}
+
+// signContent computes the HMAC-SHA256 over "{id}.{timestamp}.{body}"
+func signContent(key []byte, msgID, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fmt.Sprintf("%s.%s.", msgID, timestamp)))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
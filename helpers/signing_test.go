@@ -0,0 +1,104 @@
+package helpers
+
+import "testing"
+
+func TestSignPayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		msgID     string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			name:      "payload",
+			secret:    "s3cr3t",
+			msgID:     "msg_1",
+			timestamp: "1714000000",
+			body:      `{"event":"order.created","order_id":"12345"}`,
+			want:      "f251915e5997c3349825ecef83d5d4600281ad6b97ad6daceb3f18f23a315380",
+		},
+		{
+			name:      "empty body",
+			secret:    "s3cr3t",
+			msgID:     "msg_1",
+			timestamp: "1714000000",
+			body:      "",
+			want:      "9a2deb58799df1307a7397e616ace29a23a28abb00ea1c3df5b5929a9aec9142",
+		},
+		{
+			name:      "other secret",
+			secret:    "other",
+			msgID:     "msg_1",
+			timestamp: "1714000000",
+			body:      `{"event":"order.created","order_id":"12345"}`,
+			want:      "b12e22045ade14eee033b8c0ba4e8700370f5966d5808d4e5007fce9ba0ffaf1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SignPayload(tt.secret, tt.msgID, tt.timestamp, []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("SignPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignStandardPayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		msgID     string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			// test vector of the Standard Webhooks spec
+			name:      "spec vector",
+			secret:    "whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw",
+			msgID:     "msg_p5jXN8AQM9LWM0D4loKWxJek",
+			timestamp: "1614265330",
+			body:      `{"test": 2432232314}`,
+			want:      "g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE=",
+		},
+		{
+			// never saved on a subscription, nothing to sign with
+			name:      "invalid secret",
+			secret:    "not-a-whsec-secret",
+			msgID:     "msg_1",
+			timestamp: "1714000000",
+			body:      `{"a":1}`,
+			want:      "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SignStandardPayload(tt.secret, tt.msgID, tt.timestamp, []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("SignStandardPayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateStandardSecret(t *testing.T) {
+	tests := []struct {
+		secret  string
+		wantErr bool
+	}{
+		{"whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw", false},
+		{"MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw", true},
+		{"whsec_not base64!", true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateStandardSecret(tt.secret); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateStandardSecret(%q) error = %v, wantErr %v", tt.secret, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// longest Retry-After we honor, receivers sometimes send absurd values
+const maxRetryAfter = 24 * time.Hour
+
+// extends the throttle window of a subscription, never shortens it
+var extendThrottleScript = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], '1', 'PX', ARGV[1])
+end
+return 1
+`)
+
+func throttleKey(subID uuid.UUID) string {
+	return fmt.Sprintf("throttle:%s", subID)
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as an HTTP-date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = date.Sub(now)
+	} else {
+		return 0, false
+	}
+
+	return min(max(delay, 0), maxRetryAfter), true
+}
+
+// retryAfter returns the wait asked for by a 429 or 503 response, if any
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+}
+
+// throttle makes every task of the subscription wait until the receiver is ready again
+func (wd *WorkerDependencies) throttle(ctx context.Context, subID uuid.UUID, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	if err := extendThrottleScript.Run(ctx, wd.RedisClient, []string{throttleKey(subID)}, delay.Milliseconds()).Err(); err != nil {
+		log.Printf("Failed to store throttle for subscription %s: %v", subID, err)
+	}
+}
+
+// throttledFor returns how long the receiver of the subscription asked us to hold off
+func (wd *WorkerDependencies) throttledFor(ctx context.Context, subID uuid.UUID) time.Duration {
+	ttl, err := wd.RedisClient.PTTL(ctx, throttleKey(subID)).Result()
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	return ttl
+}
@@ -0,0 +1,37 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 4, 26, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"seconds", "120", 2 * time.Minute, true},
+		{"seconds with spaces", " 30 ", 30 * time.Second, true},
+		{"zero", "0", 0, true},
+		{"negative seconds", "-5", 0, true},
+		{"http date", "Sat, 26 Apr 2025 12:05:00 GMT", 5 * time.Minute, true},
+		{"http date in the past", "Sat, 26 Apr 2025 11:00:00 GMT", 0, true},
+		{"capped", "604800", maxRetryAfter, true},
+		{"missing", "", 0, false},
+		{"garbage", "soon", 0, false},
+		{"fraction", "1.5", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,33 +1,46 @@
 package helpers
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"os"
 	"time"
 
+	"github.com/Miku7676/webhook-delivery-service/config"
 	"github.com/Miku7676/webhook-delivery-service/models"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+// how long recording the outcome of an attempt may take
+const bookkeepingTimeout = 5 * time.Second
+
 type WorkerDependencies struct {
+	DB          *gorm.DB
 	RedisClient *redis.Client
+	QueueClient *asynq.Client // queues the batches
+	Inspector   *asynq.Inspector
+	Config      *config.Config
 }
 
-func StartWorker(rdb *redis.Client, redisOpt asynq.RedisClientOpt) {
+func StartWorker(db *gorm.DB, rdb *redis.Client, redisOpt asynq.RedisClientOpt, cfg *config.Config) {
 
 	// Create Worker dependency instance
+	queueClient := asynq.NewClient(redisOpt)
+	defer queueClient.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+
 	deps := &WorkerDependencies{
+		DB:          db,
 		RedisClient: rdb,
+		QueueClient: queueClient,
+		Inspector:   inspector,
+		Config:      cfg,
 	}
 
 	// Setup Asynq server
@@ -36,15 +49,20 @@ func StartWorker(rdb *redis.Client, redisOpt asynq.RedisClientOpt) {
 		asynq.Config{
 			Concurrency: 5, // 5 concurrent workers
 			Queues: map[string]int{
-				"default": 10, // Queue configuration
+				DefaultQueue: 10, // Queue configuration
 			},
-			RetryDelayFunc: asynq.DefaultRetryDelayFunc, // Exponential backoff for retries - builtin function
+			RetryDelayFunc: deps.retryDelay, // Backoff from the retry policy of the subscription
+			IsFailure:      isFailure,       // Deferred tasks keep their retries
+			// Archived tasks always get a final state
+			ErrorHandler: asynq.ErrorHandlerFunc(deps.recordArchived),
 		},
 	)
 
 	// setup taskhandler multiplexer
 	mux := asynq.NewServeMux()
-	mux.HandleFunc("webhook:deliver", deps.processWebhookTask)
+	mux.HandleFunc(TaskTypeDeliver, deps.processWebhookTask)
+	mux.HandleFunc(TaskTypeFlushBatch, deps.flushBatch)
+	mux.HandleFunc(TaskTypeDeliverBatch, deps.processBatchTask)
 
 	if err := srv.Run(mux); err != nil {
 		log.Fatalf("Could not run worker server: %v", err)
@@ -58,23 +76,151 @@ func (wd *WorkerDependencies) processWebhookTask(ctx context.Context, task *asyn
 		return err
 	}
 
-	dburl := os.Getenv("DB_URL")
-	database, err := gorm.Open(postgres.Open(dburl), &gorm.Config{})
+	// Cancelled through the API, already recorded there
+	if wd.cancelled(ctx, webhookTask.ID) {
+		log.Printf("Task %s was cancelled, not delivering it", webhookTask.ID)
+		return nil
+	}
+
+	sub, err := wd.getSubscription(ctx, webhookTask.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	// Expired tasks are of no use to the receiver anymore, stop without an error
+	if expired(webhookTask) {
+		wd.expireTask(webhookTask, sub)
+		return nil
+	}
+
+	// Disabled subscriptions don't get deliveries, keep them in the dead-letter queue for later
+	if sub.Status == models.SubscriptionDisabled {
+		log.Printf("Subscription %s is disabled, dead-lettering %s", sub.ID, webhookTask.ID)
+		wd.markFinished(models.TaskStateDead, webhookTask)
+		return fmt.Errorf("subscription is disabled: %w", asynq.SkipRetry)
+	}
+
+	// Paused subscriptions keep their tasks until they are resumed
+	if sub.Status == models.SubscriptionPaused {
+		held, err := wd.holdTask(webhookTask)
+		if err != nil {
+			log.Printf("Failed to hold task %s: %v", webhookTask.ID, err)
+			return &deferError{reason: "subscription is paused", delay: 30 * time.Second}
+		}
+		if held {
+			log.Printf("Subscription %s is paused, holding %s", sub.ID, webhookTask.ID)
+			return nil
+		}
+		// resumed in the meantime, deliver right away
+	}
+
+	// Batched subscriptions collect their tasks, they are delivered together when the batch is flushed
+	if batching(sub) {
+		return wd.bufferTask(ctx, sub, webhookTask, task.Payload())
+	}
+
+	// Ordered subscriptions deliver one task at a time, wait for the ones ingested earlier
+	if webhookTask.Sequence > 0 {
+		blocked, err := wd.orderingBlocked(webhookTask)
+		if err != nil {
+			log.Printf("Failed to check ordering of task %s: %v", webhookTask.ID, err)
+		}
+		if err != nil || blocked {
+			return &deferError{reason: "waiting for earlier deliveries", delay: orderingRetryDelay()}
+		}
+	}
+
+	// Wait while the endpoint or the subscription's limits can't take another delivery
+	slot, err := wd.waitForCapacity(ctx, sub)
 	if err != nil {
-		log.Printf("Failed to connect to database: %v", err)
 		return err
 	}
+	defer wd.releaseSlot(sub.ID, slot)
+
+	// Deliver and record the attempt
+	retryCount, _ := asynq.GetRetryCount(ctx)
+	wd.markDelivering(webhookTask)
+	result := deliver(ctx, sub, webhookTask.ID.String(), []byte(webhookTask.Payload))
+	interrupted := errors.Is(ctx.Err(), context.Canceled)
+	ctx, cancel := bookkeepingContext(ctx)
+	defer cancel()
+
+	// Cancelled through the API or the worker is shutting down, the endpoint isn't to blame
+	if result.failed() {
+		if wd.cancelled(ctx, webhookTask.ID) {
+			log.Printf("Delivery of %s was cancelled, not counting it as a failure", webhookTask.ID)
+			return nil // already recorded as cancelled
+		}
+		if interrupted {
+			log.Printf("Delivery of %s was interrupted, not counting it as a failure", webhookTask.ID)
+			return result.err
+		}
+	}
+	logAttempt(wd.DB, webhookTask, sub, retryCount+1, result)
+	wd.recordBreaker(ctx, sub.ID, result)
+	wd.recordHealth(sub, result)
+
+	if result.failed() {
+		log.Printf("Delivery failed for %s: %s", webhookTask.ID, result.ErrorMessage)
+		err := wd.deliveryFailure(ctx, sub, webhookTask, result)
+		if finalAttempt(ctx, err) {
+			wd.markFinished(failedState(result), webhookTask)
+		} else {
+			wd.markRetrying(webhookTask)
+		}
+		return err
+	}
+
+	log.Printf("Delivery successful for %s", webhookTask.ID)
+	wd.markFinished(models.TaskStateSucceeded, webhookTask)
+	return nil
+}
+
+// waitForCapacity returns a deferError while deliveries to the subscription have to wait,
+// otherwise the slot taken for the delivery, released once it is over
+func (wd *WorkerDependencies) waitForCapacity(ctx context.Context, sub models.Subscription) (string, error) {
+	// The receiver asked us to slow down (Retry-After), wait without using up a retry
+	if wait := wd.throttledFor(ctx, sub.ID); wait > 0 {
+		return "", &deferError{reason: "receiver is throttling", delay: wait}
+	}
+
+	// The endpoint keeps failing, wait until the circuit breaker lets a probe through
+	if wait := wd.breakerWait(ctx, sub.ID); wait > 0 {
+		return "", &deferError{reason: "circuit breaker open", delay: wait}
+	}
+
+	// Too many deliveries to this subscription in flight, let the other subscriptions use the worker
+	slot, ok := wd.acquireSlot(ctx, sub)
+	if !ok {
+		return "", &deferError{reason: "concurrency limit reached", delay: slotRetryDelay()}
+	}
+
+	// Over the subscription's rate limit, come back when a token is available
+	if wait := wd.rateLimitWait(ctx, sub); wait > 0 {
+		wd.releaseSlot(sub.ID, slot)
+		return "", &deferError{reason: "rate limit reached", delay: wait}
+	}
+	return slot, nil
+}
 
+// bookkeepingContext is used for recording the outcome of an attempt. The task context is already done
+// when the delivery used up the task timeout, this one isn't but keeps the task's retry count.
+func bookkeepingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+}
+
+// getSubscription fetches a subscription from the redis cache, falling back to the database
+func (wd *WorkerDependencies) getSubscription(ctx context.Context, id uuid.UUID) (models.Subscription, error) {
 	var sub models.Subscription
-	cacheKey := fmt.Sprintf("subscription:%s", webhookTask.SubscriptionID)
+	cacheKey := fmt.Sprintf("subscription:%s", id)
 
 	// fetch subscription from redis
 	val, err := wd.RedisClient.Get(ctx, cacheKey).Result()
 	if err == redis.Nil {
 		// Cache miss - fetch from DB
-		if err := database.First(&sub, "id = ?", webhookTask.SubscriptionID).Error; err != nil {
+		if err := wd.DB.First(&sub, "id = ?", id).Error; err != nil {
 			log.Printf("Subscription not found: %v", err)
-			return err
+			return sub, err
 		}
 
 		// Cache subscription
@@ -83,68 +229,118 @@ func (wd *WorkerDependencies) processWebhookTask(ctx context.Context, task *asyn
 	} else if err != nil {
 		//cache error
 		log.Printf("Failed to get subscription from cache: %v", err)
-		return err
+		return sub, err
 	} else {
 		// Cache hit
 		json.Unmarshal([]byte(val), &sub)
 	}
+	return sub, nil
+}
 
-	// Prepare HTTP client and request
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("POST", sub.TargetURL, bytes.NewBuffer([]byte(webhookTask.Payload)))
-	if err != nil {
-		log.Printf("Request creation failed: %v", err)
-		retryCount, _ := asynq.GetRetryCount(ctx)
-		logAttempt(database, webhookTask, sub, retryCount+1, "Failed", 500, err.Error()) // server error, failed to create request
-		return err
+// retryDelay is the asynq RetryDelayFunc, it applies the retry policy of the task's subscription
+func (wd *WorkerDependencies) retryDelay(n int, e error, t *asynq.Task) time.Duration {
+	// Deferred tasks come back once the reason for deferring is gone
+	var deferErr *deferError
+	if errors.As(e, &deferErr) {
+		return deferErr.delay
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// Send HTTP request to subscription url
-	resp, err := client.Do(req)
+	webhookTask, err := retryPolicyTask(t)
 	if err != nil {
-		log.Printf("Delivery failed: %v", err)
-		retryCount, _ := asynq.GetRetryCount(ctx)
-		logAttempt(database, webhookTask, sub, retryCount+1, "Failed", 404, err.Error()) // assumed that the url does not exist
-		return err
+		return asynq.DefaultRetryDelayFunc(n, e, t)
+	}
+	sub, err := wd.getSubscription(context.Background(), webhookTask.SubscriptionID)
+	if err != nil {
+		return asynq.DefaultRetryDelayFunc(n, e, t)
 	}
-	defer resp.Body.Close()
 
-	// Handle HTTP response
-	status := "Success"
-	errorMessage := ""
-	if resp.StatusCode >= 300 {
-		status = "Failed"
+	delay := RetryDelay(sub, n, e, t)
 
-		// Read body (optional, but useful for debugging why it failed)
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		errorMessage = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, string(bodyBytes))
+	// the receiver told us when to come back
+	var retryAfterErr *retryAfterError
+	if errors.As(e, &retryAfterErr) {
+		delay = retryAfterErr.delay
+	}
 
-		log.Printf("Received non-2xx response: %s", errorMessage)
+	// never wait past the retry deadline, the attempt at the deadline is the last one
+	if deadline, ok := RetryDeadline(sub, webhookTask); ok {
+		delay = min(delay, max(time.Until(deadline), 0))
+	}
+	// an expired task only comes back to be recorded as expired
+	if webhookTask.ExpiresAt != nil {
+		delay = min(delay, max(time.Until(*webhookTask.ExpiresAt), 0))
 	}
 
-	retryCount, _ := asynq.GetRetryCount(ctx)
-	logAttempt(database, webhookTask, sub, retryCount+1, status, resp.StatusCode, errorMessage)
-	if status == "Failed" {
-		return fmt.Errorf("Non-2xx status code: %d", resp.StatusCode)
+	wd.recordNextRetry(t, delay)
+	return delay
+}
+
+// deliveryFailure turns a failed attempt into the error returned to asynq
+func (wd *WorkerDependencies) deliveryFailure(ctx context.Context, sub models.Subscription, task models.WebhookTask, result attemptResult) error {
+	err := result.err
+
+	// Honor Retry-After for this task and hold back the other tasks of the subscription too
+	if result.hasRetryAfter {
+		wd.throttle(ctx, sub.ID, result.retryAfter)
+		err = &retryAfterError{err: err, delay: result.retryAfter}
 	}
 
-	log.Printf("Delivery successful for %s", webhookTask.ID)
-	return nil
+	err = deliveryError(sub, task, result.FailureClass, err)
+	if !errors.Is(err, asynq.SkipRetry) && retriesUsedUp(ctx) {
+		err = fmt.Errorf("%v, no retries left: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// deliveryError decides whether asynq retries a failed delivery.
+// Permanent failures and failures after the subscription's retry deadline are archived right away.
+func deliveryError(sub models.Subscription, task models.WebhookTask, failureClass string, err error) error {
+	if failureClass == models.FailurePermanent {
+		return fmt.Errorf("%v, permanent failure: %w", err, asynq.SkipRetry)
+	}
+	if deadline, ok := RetryDeadline(sub, task); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("%v, retry deadline passed: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// retriesUsedUp tells whether the attempt was the last one the retry policy allows,
+// asynq still has its spare retry for deferrals then (see queueMaxRetry)
+func retriesUsedUp(ctx context.Context) bool {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	return retried >= PolicyMaxRetry(maxRetry)
+}
+
+// finalAttempt tells whether asynq archives the task instead of retrying it after this error
+func finalAttempt(ctx context.Context, err error) bool {
+	if errors.Is(err, asynq.SkipRetry) {
+		return true
+	}
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	return retried >= maxRetry
 }
 
 // logAttempt records a delivery attempt into the DeliveryLog table
-func logAttempt(db *gorm.DB, task models.WebhookTask, sub models.Subscription, attempt int, status string, httpStatus int, errMsg string) {
+func logAttempt(db *gorm.DB, task models.WebhookTask, sub models.Subscription, attempt int, result attemptResult) {
 	logEntry := models.DeliveryLog{
-		ID:             uuid.New(),
-		WebhookTaskID:  task.ID,
-		SubscriptionID: task.SubscriptionID,
-		TargetURL:      sub.TargetURL,
-		AttemptNumber:  attempt,
-		Status:         status,
-		HTTPStatus:     httpStatus,
-		ErrorMessage:   errMsg,
-		CreatedAt:      time.Now(),
+		ID:              uuid.New(),
+		WebhookTaskID:   task.ID,
+		SubscriptionID:  task.SubscriptionID,
+		TargetURL:       sub.TargetURL,
+		AttemptNumber:   attempt,
+		Status:          result.Status,
+		HTTPStatus:      result.HTTPStatus,
+		ErrorMessage:    result.ErrorMessage,
+		FailureClass:    result.FailureClass,
+		ErrorCategory:   result.ErrorCategory,
+		DurationMs:      result.Duration.Milliseconds(),
+		ResponseHeaders: result.ResponseHeaders,
+		ResponseBody:    result.ResponseBody,
+		RedeliveryOf:    task.RedeliveryOf,
+		BatchID:         task.BatchID,
+		CreatedAt:       time.Now(),
 	}
 	if err := db.Create(&logEntry).Error; err != nil {
 		log.Printf("Failed to log delivery attempt: %v", err)
@@ -6,32 +6,275 @@ import (
 	"github.com/google/uuid"
 )
 
+// Signature schemes used to sign outgoing deliveries
+const (
+	SignatureSchemeDefault          = "default"           // X-Webhook-* headers, hex HMAC over id.timestamp.body
+	SignatureSchemeStandardWebhooks = "standard_webhooks" // webhook-* headers as per the Standard Webhooks spec
+)
+
+// Backoff strategies used between delivery retries
+const (
+	BackoffExponential = "exponential" // asynq's default exponential backoff
+	BackoffLinear      = "linear"      // backoff_interval, 2x backoff_interval, 3x backoff_interval...
+	BackoffFixed       = "fixed"       // backoff_schedule in order, the last value repeats (or backoff_interval every time)
+)
+
+// Subscription statuses
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPaused   = "paused"   // deliveries are held until the subscription is resumed
+	SubscriptionDisabled = "disabled" // turned off after failing for too long, deliveries are dead-lettered
+)
+
 type Subscription struct {
-	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	TargetURL string    `json:"target_url"`
-	Secret    string    `json:"secret"`
+	ID              uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	TargetURL       string    `json:"target_url"`
+	Secret          string    `json:"secret"`
+	SignatureScheme string    `json:"signature_scheme"`
+	EventTypes      []string  `gorm:"type:jsonb;serializer:json" json:"event_types"` // event types delivered through POST /events, "*" matches all
+
+	// Retry policy, zero values fall back to the defaults (6 attempts, exponential backoff)
+	MaxAttempts     int    `json:"max_attempts"`                                       // first attempt included
+	BackoffStrategy string `json:"backoff_strategy"`                                   // exponential, linear or fixed
+	BackoffInterval int    `json:"backoff_interval"`                                   // seconds, used by linear and fixed
+	BackoffSchedule []int  `gorm:"type:jsonb;serializer:json" json:"backoff_schedule"` // seconds, used by fixed
+	MaxBackoff      int    `json:"max_backoff"`                                        // seconds, caps a single backoff
+	RetryDeadline   int    `json:"retry_deadline"`                                     // seconds after the task was created, no retries after that
+	DefaultTTL      int    `json:"default_ttl"`                                        // seconds after the task was created, not attempted after that
+
+	// Outbound rate limit, shared by all workers (0 means unlimited)
+	RateLimit      float64 `json:"rate_limit"`       // requests per second
+	RateLimitBurst int     `json:"rate_limit_burst"` // requests allowed at once, defaults to the rate rounded up
+	MaxConcurrency int     `json:"max_concurrency"`  // deliveries in flight at once, 0 uses the worker default
+
+	// Ordered delivery: one delivery at a time in ingest order, per value of the ordering key when set
+	Ordered     bool   `json:"ordered"`
+	OrderingKey string `json:"ordering_key"` // payload field, e.g. "order_id" or "data.order_id"
+
+	// Batched delivery: pending deliveries are POSTed together as a JSON array
+	BatchSize    int `json:"batch_size"`     // deliveries per request, 0 or 1 delivers them one by one
+	BatchMaxWait int `json:"batch_max_wait"` // seconds the first delivery of a batch waits for the others, default 5
+
+	// Health, maintained by the worker
+	Status              string     `gorm:"default:active" json:"status"`
+	NotificationURL     string     `json:"notification_url"` // notified when the subscription gets disabled
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	DisabledReason      string     `json:"disabled_reason"`
 }
 
 type CreateSubscriptionRequest struct { // this struct is only to modify the request body of swagger.
-	TargetURL string `json:"target_url" binding:"required"`
-	Secret    string `json:"secret"`
+	TargetURL       string   `json:"target_url" binding:"required"`
+	Secret          string   `json:"secret"`
+	SignatureScheme string   `json:"signature_scheme" binding:"omitempty,oneof=default standard_webhooks"`
+	EventTypes      []string `json:"event_types"`
+	MaxAttempts     int      `json:"max_attempts" binding:"min=0"`
+	BackoffStrategy string   `json:"backoff_strategy" binding:"omitempty,oneof=exponential linear fixed"`
+	BackoffInterval int      `json:"backoff_interval" binding:"min=0"`
+	BackoffSchedule []int    `json:"backoff_schedule"`
+	MaxBackoff      int      `json:"max_backoff" binding:"min=0"`
+	RetryDeadline   int      `json:"retry_deadline" binding:"min=0"`
+	DefaultTTL      int      `json:"default_ttl" binding:"min=0"`
+	NotificationURL string   `json:"notification_url" binding:"omitempty,url"`
+	RateLimit       float64  `json:"rate_limit" binding:"min=0"`
+	RateLimitBurst  int      `json:"rate_limit_burst" binding:"min=0"`
+	MaxConcurrency  int      `json:"max_concurrency" binding:"min=0"`
+	Ordered         bool     `json:"ordered"`
+	OrderingKey     string   `json:"ordering_key"`
+	BatchSize       int      `json:"batch_size" binding:"min=0,max=500"`
+	BatchMaxWait    int      `json:"batch_max_wait" binding:"min=0"`
+}
+
+type PublishEventRequest struct {
+	Type string                 `json:"type" binding:"required" example:"order.created"`
+	Data map[string]interface{} `json:"data" binding:"required"`
 }
 
 type WebhookTask struct {
-	ID             uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	SubscriptionID uuid.UUID `gorm:"type:uuid" json:"subscription_id"`
-	Payload        string    `json:"payload"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;index:idx_webhook_tasks_ordering,priority:1" json:"subscription_id"`
+	EventType      string     `json:"event_type"`
+	Payload        string     `json:"payload"`
+	RedeliveryOf   *uuid.UUID `gorm:"type:uuid;index" json:"redelivery_of,omitempty"` // original task when this is a redelivery
+	HeldAt         *time.Time `gorm:"index" json:"held_at,omitempty"`                 // parked while the subscription is paused
+	ScheduledAt    *time.Time `json:"scheduled_at,omitempty"`                         // not delivered before this time
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`                           // not delivered after this time
+	CreatedAt      time.Time  `json:"created_at"`
+
+	// Ordered subscriptions only, a task waits for every task with a lower sequence and the same ordering key
+	OrderingKey string `gorm:"index:idx_webhook_tasks_ordering,priority:2" json:"ordering_key,omitempty"`
+	Sequence    int64  `gorm:"index:idx_webhook_tasks_ordering,priority:3" json:"sequence,omitempty"`
+
+	BatchID *uuid.UUID `gorm:"type:uuid;index" json:"batch_id,omitempty"` // batch the task was last delivered in
+
+	// Lifecycle, maintained by the worker
+	State         string     `gorm:"default:queued;index" json:"state"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	NextRetryAt   *time.Time `json:"next_retry_at,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"` // reached a final state, the next ordered task may go
 }
 
-type DeliveryLog struct {
-	ID             uuid.UUID `gorm:"type:uuid;primaryKey"`
+// OutboxMessage is a task waiting to be queued, written in the transaction creating the task.
+// The API queues it right away when it can, the relay in the worker takes care of the rest.
+type OutboxMessage struct {
+	ID            uint64    `gorm:"primaryKey"` // insertion order
+	WebhookTaskID uuid.UUID `gorm:"type:uuid;index"`
+	Attempts      int       // failed relay attempts
+	LastError     string
+	CreatedAt     time.Time
+}
+
+// IdempotencyKey is an Idempotency-Key sent to ingest. Repeats of the key within its window get the
+// task of the first request instead of a new one.
+type IdempotencyKey struct {
+	SubscriptionID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Key            string    `gorm:"primaryKey"`
+	RequestHash    string    // sha256 of the payload, a reused key has to come with the same payload
 	WebhookTaskID  uuid.UUID `gorm:"type:uuid"`
-	SubscriptionID uuid.UUID `gorm:"type:uuid"`
-	TargetURL      string    `json:"target_url"`
-	AttemptNumber  int       `json:"attempt_number"`
-	Status         string    `json:"status"`
-	HTTPStatus     int       `json:"http_status"`
-	ErrorMessage   string    `json:"error_message"`
-	CreatedAt      time.Time `json:"created_at"`
+	CreatedAt      time.Time
+	ExpiresAt      time.Time `gorm:"index"`
+}
+
+// Webhook task states
+const (
+	TaskStateQueued     = "queued"     // waiting for its first attempt, also while scheduled or held
+	TaskStateDelivering = "delivering" // attempt in progress
+	TaskStateRetrying   = "retrying"   // last attempt failed, another one is scheduled
+	TaskStateSucceeded  = "succeeded"
+	TaskStateFailed     = "failed" // permanent failure, dead-lettered without retries
+	TaskStateDead       = "dead"   // used up its retries, dead-lettered
+	TaskStateCancelled  = "cancelled"
+	TaskStateExpired    = "expired"
+)
+
+type WebhookStatus struct { // response body of the status API
+	Task       WebhookTask   `json:"task"`
+	Attempts   []DeliveryLog `json:"attempts"`              // including the attempts of its redeliveries
+	QueueState string        `json:"queue_state,omitempty"` // state of its asynq task, "not_queued" when there is none
+}
+
+// OrderingSequence hands out the sequence numbers of an ordered subscription, one row per ordering key
+type OrderingSequence struct {
+	SubscriptionID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	OrderingKey    string    `gorm:"primaryKey"`
+	LastSequence   int64
+}
+
+// Delivery log statuses of tasks that ended without an attempt, besides Success and Failed
+const (
+	DeliveryExpired   = "Expired"   // the task outlived its TTL
+	DeliveryCancelled = "Cancelled" // cancelled through the API
+)
+
+// Failure classes recorded on failed delivery attempts
+const (
+	FailureRetryable = "retryable" // network errors, 5xx, 408, 429 - retried with backoff
+	FailurePermanent = "permanent" // other 4xx, invalid URLs, TLS verification errors - not retried
+)
+
+// Error categories recorded on failed delivery attempts
+const (
+	ErrorCategoryDNS     = "dns"     // target host could not be resolved
+	ErrorCategoryConnect = "connect" // connection could not be established
+	ErrorCategoryTLS     = "tls"     // TLS handshake or certificate verification failed
+	ErrorCategoryTimeout = "timeout" // no response within the delivery timeout
+	ErrorCategoryNetwork = "network" // connection broke after it was established
+	ErrorCategoryHTTP    = "http"    // receiver answered with a non-2xx status
+	ErrorCategoryRequest = "request" // request could not be built, e.g. invalid target URL
+)
+
+type DeliveryLog struct {
+	ID              uuid.UUID         `gorm:"type:uuid;primaryKey"`
+	WebhookTaskID   uuid.UUID         `gorm:"type:uuid"`
+	SubscriptionID  uuid.UUID         `gorm:"type:uuid"`
+	TargetURL       string            `json:"target_url"`
+	AttemptNumber   int               `json:"attempt_number"`
+	Status          string            `json:"status"`
+	HTTPStatus      int               `json:"http_status"` // 0 when no response was received
+	ErrorMessage    string            `json:"error_message"`
+	FailureClass    string            `json:"failure_class"`
+	ErrorCategory   string            `json:"error_category"`
+	DurationMs      int64             `json:"duration_ms"`
+	ResponseHeaders map[string]string `gorm:"type:jsonb;serializer:json" json:"response_headers"`
+	ResponseBody    string            `json:"response_body"` // truncated
+	RedeliveryOf    *uuid.UUID        `gorm:"type:uuid;index" json:"redelivery_of,omitempty"`
+	BatchID         *uuid.UUID        `gorm:"type:uuid;index" json:"batch_id,omitempty"` // set when the attempt delivered a batch, the outcome is the batch's
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// Replay job statuses
+const (
+	ReplayStatusRunning   = "running"
+	ReplayStatusCompleted = "completed"
+	ReplayStatusFailed    = "failed"
+)
+
+type ReplayJob struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;index" json:"subscription_id"`
+	From           time.Time  `json:"from"`
+	To             time.Time  `json:"to"`
+	StatusFilter   string     `json:"status_filter"`
+	Rate           int        `json:"rate"` // tasks re-enqueued per second
+	Status         string     `json:"status"`
+	Total          int        `json:"total"`
+	Enqueued       int        `json:"enqueued"`
+	Error          string     `json:"error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	CompletedAt    *time.Time `json:"completed_at"`
+
+	// Worker running the job, updated_at is its heartbeat. The cursor is the last task re-enqueued.
+	Owner           string     `json:"-"`
+	CursorCreatedAt *time.Time `json:"-"`
+	CursorTaskID    *uuid.UUID `gorm:"type:uuid" json:"-"`
+}
+
+type ReplayRequest struct {
+	From   time.Time `json:"from" binding:"required"`
+	To     time.Time `json:"to" binding:"required"`
+	Status string    `json:"status" binding:"omitempty,oneof=all failed"` // defaults to failed
+	Rate   int       `json:"rate" binding:"omitempty,min=1,max=100"`      // defaults to 10 per second
+}
+
+type DeadLetter struct { // response body of the dead letter API, built from archived asynq tasks
+	ID             string    `json:"id"`
+	WebhookTaskID  uuid.UUID `json:"webhook_task_id"`
+	SubscriptionID uuid.UUID `json:"subscription_id"`
+	EventType      string    `json:"event_type"`
+	Payload        string    `json:"payload"`
+	Retried        int       `json:"retried"`
+	MaxRetry       int       `json:"max_retry"`
+	LastError      string    `json:"last_error"`
+	LastFailedAt   time.Time `json:"last_failed_at"`
+
+	// dead-lettered batches, the tasks delivered together
+	BatchID        *uuid.UUID  `json:"batch_id,omitempty"`
+	WebhookTaskIDs []uuid.UUID `json:"webhook_task_ids,omitempty"`
+}
+
+type ScheduledDelivery struct { // response body of the scheduled deliveries API, built from webhook tasks waiting for their delivery time
+	ID             string    `json:"id"` // asynq task ID, the same as the webhook task ID
+	WebhookTaskID  uuid.UUID `json:"webhook_task_id"`
+	SubscriptionID uuid.UUID `json:"subscription_id"`
+	EventType      string    `json:"event_type"`
+	Payload        string    `json:"payload"`
+	DeliverAt      time.Time `json:"deliver_at"`
+}
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"    // deliveries flow normally
+	BreakerOpen     = "open"      // deliveries are deferred without being attempted
+	BreakerHalfOpen = "half_open" // a single probe delivery is let through
+)
+
+type BreakerState struct { // response body of the circuit breaker API, read from redis
+	SubscriptionID      uuid.UUID  `json:"subscription_id"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at"`
+	RetryAt             *time.Time `json:"retry_at"` // when the next probe is let through
 }